@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"sipblf/state"
+)
+
+// Alert is a notification that a rule started or stopped matching
+type Alert struct {
+	Rule string `json:"rule"`
+	// Status is "firing" or "resolved"
+	Status string `json:"status"`
+	// Extension is empty for count rules
+	Extension   string      `json:"extension,omitempty"`
+	Description string      `json:"description,omitempty"`
+	State       state.State `json:"state"`
+	Count       int         `json:"count,omitempty"`
+	Since       time.Time   `json:"since"`
+	Time        time.Time   `json:"time"`
+	Message     string      `json:"message"`
+}
+
+// Notifier delivers alerts
+type Notifier interface {
+	// Name identifies the notifier in rules and logs
+	Name() string
+	Notify(ctx context.Context, a Alert) error
+}
+
+// alertRule is a configured rule with its pattern, states and notifiers resolved
+type alertRule struct {
+	AlertRuleConfig
+	extensions *regexp.Regexp
+	states     []state.State
+	notifiers  []Notifier
+}
+
+// matches reports whether the rule covers ext
+func (r *alertRule) matches(ext string) bool {
+	return r.extensions.MatchString(ext)
+}
+
+// alertCondition is a rule currently matching an extension (or, for count
+// rules, enough extensions), waiting out the rule's duration or firing
+type alertCondition struct {
+	rule        *alertRule
+	extension   string
+	description string
+	state       state.State
+	count       int
+	since       time.Time
+	firing      bool
+}
+
+// AlertEngine evaluates alert rules against extension state changes. An
+// alert fires once when its condition has held for the rule's duration,
+// and sends a recovery notification when the condition clears.
+type AlertEngine struct {
+	mu         sync.Mutex
+	rules      []*alertRule
+	conditions map[string]*alertCondition
+	now        func() time.Time // now returns the current time; tests replace it
+}
+
+// alerts is the configured alert engine
+var alerts = &AlertEngine{conditions: make(map[string]*alertCondition), now: time.Now}
+
+// Configure replaces the rules and notifiers. Conditions of unchanged rules
+// are kept, so a reload does not repeat alerts that are already firing.
+func (e *AlertEngine) Configure(c AlertsConfig) error {
+	apply, err := e.Prepare(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare builds the rules and notifiers of a configuration and returns a
+// function that switches to them, as Configure does
+func (e *AlertEngine) Prepare(c AlertsConfig) (func(), error) {
+	notifiers := make(map[string]Notifier)
+	for _, nc := range c.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", nc.Name, err)
+		}
+		notifiers[nc.Name] = n
+	}
+
+	var rules []*alertRule
+	for _, rc := range c.Rules {
+		re, err := regexp.Compile(rc.Extensions)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rc.Name, err)
+		}
+		rule := &alertRule{AlertRuleConfig: rc, extensions: re}
+		for _, s := range rc.States {
+			rule.states = append(rule.states, state.Parse(s))
+		}
+		for _, name := range rc.Notify {
+			rule.notifiers = append(rule.notifiers, notifiers[name])
+		}
+		rules = append(rules, rule)
+	}
+
+	return func() {
+		e.mu.Lock()
+		old := make(map[string]*alertRule)
+		for _, r := range e.rules {
+			old[r.Name] = r
+		}
+		e.rules = rules
+		for key, cond := range e.conditions {
+			kept := false
+			for _, r := range rules {
+				if prev := old[r.Name]; prev == cond.rule && reflect.DeepEqual(prev.AlertRuleConfig, r.AlertRuleConfig) {
+					cond.rule = r
+					kept = true
+				}
+			}
+			if !kept {
+				delete(e.conditions, key)
+			}
+		}
+		e.mu.Unlock()
+
+		// Pick up conditions that already hold, e.g. extensions that were
+		// unavailable before startup
+		for _, endpoint := range visibleEndpoints(ScopeAll) {
+			e.Observe(endpoint)
+		}
+	}, nil
+}
+
+// Observe updates the conditions affected by an extension's new state
+func (e *AlertEngine) Observe(endpoint state.Endpoint) {
+	e.mu.Lock()
+	rules := e.rules
+	e.mu.Unlock()
+
+	var counts map[*alertRule]int
+	for _, r := range rules {
+		if r.CountAbove > 0 && r.matches(endpoint.Extension) {
+			if counts == nil {
+				counts = e.countMatching(rules)
+			}
+		}
+	}
+
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range rules {
+		if !r.matches(endpoint.Extension) {
+			continue
+		}
+		if r.CountAbove > 0 {
+			key := r.Name
+			if counts[r] > r.CountAbove {
+				if cond, ok := e.conditions[key]; ok {
+					cond.count = counts[r]
+				} else {
+					e.conditions[key] = &alertCondition{rule: r, state: r.states[0], count: counts[r], since: now}
+				}
+			} else if cond, ok := e.conditions[key]; ok {
+				cond.count = counts[r]
+				e.clear(key, cond, endpoint.Status, now)
+			}
+			continue
+		}
+
+		key := r.Name + "\x00" + endpoint.Extension
+		cond, ok := e.conditions[key]
+		if slices.Contains(r.states, endpoint.Status) {
+			if !ok {
+				since := endpoint.Since
+				if since.IsZero() {
+					since = now
+				}
+				e.conditions[key] = &alertCondition{
+					rule:        r,
+					extension:   endpoint.Extension,
+					description: endpoint.Description,
+					state:       endpoint.Status,
+					since:       since,
+				}
+			}
+		} else if ok {
+			e.clear(key, cond, endpoint.Status, now)
+		}
+	}
+}
+
+// countMatching counts, for each count rule, the extensions in its states
+func (e *AlertEngine) countMatching(rules []*alertRule) map[*alertRule]int {
+	counts := make(map[*alertRule]int)
+	for _, endpoint := range extensionCache.List(isExtension, false) {
+		for _, r := range rules {
+			if r.CountAbove > 0 && r.matches(endpoint.Extension) && slices.Contains(r.states, endpoint.Status) {
+				counts[r]++
+			}
+		}
+	}
+	return counts
+}
+
+// clear removes a condition that no longer holds, sending a recovery
+// notification if it had fired. The caller must hold e.mu.
+func (e *AlertEngine) clear(key string, cond *alertCondition, status state.State, now time.Time) {
+	delete(e.conditions, key)
+	if !cond.firing {
+		return
+	}
+	a := cond.alert("resolved", now)
+	if cond.extension != "" {
+		a.State = status
+		a.Message = fmt.Sprintf("[%s] Extension %s is now %s, after %s %s",
+			cond.rule.Name, describeExtension(cond.extension, cond.description), status, now.Sub(cond.since).Round(time.Second), cond.state)
+	} else {
+		a.Message = fmt.Sprintf("[%s] %d extensions are %s, no longer more than %d",
+			cond.rule.Name, cond.count, stateList(cond.rule.states), cond.rule.CountAbove)
+	}
+	e.send(cond.rule, a)
+}
+
+// Run fires conditions that have held for their rule's duration. It checks
+// every second, so "for" durations are accurate to about a second.
+func (e *AlertEngine) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.check()
+	}
+}
+
+// check fires the conditions that have held long enough
+func (e *AlertEngine) check() {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, cond := range e.conditions {
+		if cond.firing || now.Sub(cond.since) < cond.rule.For {
+			continue
+		}
+		cond.firing = true
+		a := cond.alert("firing", now)
+		if cond.extension != "" {
+			a.Message = fmt.Sprintf("[%s] Extension %s has been %s for %s",
+				cond.rule.Name, describeExtension(cond.extension, cond.description), cond.state, now.Sub(cond.since).Round(time.Second))
+		} else {
+			a.Message = fmt.Sprintf("[%s] %d extensions are %s, more than %d",
+				cond.rule.Name, cond.count, stateList(cond.rule.states), cond.rule.CountAbove)
+		}
+		e.send(cond.rule, a)
+	}
+}
+
+func (cond *alertCondition) alert(status string, now time.Time) Alert {
+	return Alert{
+		Rule:        cond.rule.Name,
+		Status:      status,
+		Extension:   cond.extension,
+		Description: cond.description,
+		State:       cond.state,
+		Count:       cond.count,
+		Since:       cond.since,
+		Time:        now,
+	}
+}
+
+// send delivers an alert to each of the rule's notifiers in the background
+func (e *AlertEngine) send(r *alertRule, a Alert) {
+	log.Printf("Alert %s: %s", a.Status, a.Message)
+	for _, n := range r.notifiers {
+		go func(n Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := n.Notify(ctx, a); err != nil {
+				log.Printf("Warning: Alert notifier %s failed: %v", n.Name(), err)
+				return
+			}
+			slog.Debug("Alert sent", "notifier", n.Name(), "rule", a.Rule, "status", a.Status)
+		}(n)
+	}
+}
+
+func describeExtension(ext, description string) string {
+	if description == "" {
+		return ext
+	}
+	return fmt.Sprintf("%s (%s)", ext, description)
+}
+
+func stateList(states []state.State) string {
+	s := ""
+	for i, st := range states {
+		if i > 0 {
+			s += " or "
+		}
+		s += st.String()
+	}
+	return s
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"sipblf/state"
+)
+
+// fakeNotifier passes alerts to the test
+type fakeNotifier struct {
+	alerts chan Alert
+}
+
+func (n *fakeNotifier) Name() string { return "fake" }
+
+func (n *fakeNotifier) Notify(ctx context.Context, a Alert) error {
+	n.alerts <- a
+	return nil
+}
+
+// received waits for n alerts, described as "status extension" or, for
+// count rules, "status count", and checks that no more arrive
+func (n *fakeNotifier) received(t *testing.T, count int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < count {
+		select {
+		case a := <-n.alerts:
+			got = append(got, describeAlert(a))
+		case <-time.After(time.Second):
+			t.Fatalf("got alerts %v, want %d", got, count)
+		}
+	}
+	select {
+	case a := <-n.alerts:
+		t.Fatalf("unexpected alert %s after %v", describeAlert(a), got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	sort.Strings(got)
+	return got
+}
+
+func describeAlert(a Alert) string {
+	if a.Extension == "" {
+		return fmt.Sprintf("%s %d", a.Status, a.Count)
+	}
+	return a.Status + " " + a.Extension
+}
+
+// step is one thing that happens to the engine under test
+type step struct {
+	// advance moves the clock first
+	advance time.Duration
+	// ext and status, if set, are observed as an extension's new state
+	ext    string
+	status state.State
+	// since, if set, is how long the extension has been in the state
+	since time.Duration
+	// check runs the periodic check for conditions that have held long enough
+	check bool
+	want  []string
+}
+
+func TestAlertEngine(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []AlertRuleConfig
+		steps []step
+	}{
+		{
+			name:  "fires after the duration, once",
+			rules: []AlertRuleConfig{{Name: "down", Extensions: "^1", States: []string{"UNAVAILABLE"}, For: 5 * time.Minute}},
+			steps: []step{
+				{ext: "100", status: state.Unavailable},
+				{advance: 4 * time.Minute, check: true},
+				{advance: time.Minute, check: true, want: []string{"firing 100"}},
+				{advance: time.Minute, check: true},
+				{ext: "100", status: state.Unavailable},
+				{advance: time.Minute, check: true},
+				{ext: "100", status: state.NotInUse, want: []string{"resolved 100"}},
+				{advance: 10 * time.Minute, check: true},
+			},
+		},
+		{
+			name:  "clearing before the duration sends nothing",
+			rules: []AlertRuleConfig{{Name: "down", States: []string{"UNAVAILABLE"}, For: 5 * time.Minute}},
+			steps: []step{
+				{ext: "100", status: state.Unavailable},
+				{advance: 4 * time.Minute, check: true},
+				{ext: "100", status: state.NotInUse},
+				{advance: 2 * time.Minute, check: true},
+				// A new condition starts its duration again
+				{ext: "100", status: state.Unavailable},
+				{advance: 4 * time.Minute, check: true},
+				{advance: time.Minute, check: true, want: []string{"firing 100"}},
+			},
+		},
+		{
+			name:  "duration counts from when the extension entered the state",
+			rules: []AlertRuleConfig{{Name: "down", States: []string{"UNAVAILABLE"}, For: 5 * time.Minute}},
+			steps: []step{
+				{ext: "100", status: state.Unavailable, since: 10 * time.Minute},
+				{check: true, want: []string{"firing 100"}},
+			},
+		},
+		{
+			name:  "each extension alerts on its own",
+			rules: []AlertRuleConfig{{Name: "ringing", States: []string{"RINGING"}, For: time.Minute}},
+			steps: []step{
+				{ext: "100", status: state.Ringing},
+				{advance: 30 * time.Second, ext: "101", status: state.Ringing},
+				{advance: 30 * time.Second, check: true, want: []string{"firing 100"}},
+				{advance: 30 * time.Second, check: true, want: []string{"firing 101"}},
+				{ext: "100", status: state.InUse, want: []string{"resolved 100"}},
+				{ext: "101", status: state.NotInUse, want: []string{"resolved 101"}},
+			},
+		},
+		{
+			name:  "extensions outside the pattern are ignored",
+			rules: []AlertRuleConfig{{Name: "down", Extensions: "^1", States: []string{"UNAVAILABLE"}}},
+			steps: []step{
+				{ext: "200", status: state.Unavailable},
+				{check: true},
+			},
+		},
+		{
+			name:  "count rule",
+			rules: []AlertRuleConfig{{Name: "busy", States: []string{"INUSE", "ONHOLD"}, CountAbove: 1, For: time.Minute}},
+			steps: []step{
+				{ext: "100", status: state.InUse},
+				{check: true},
+				{ext: "101", status: state.OnHold},
+				{advance: 59 * time.Second, check: true},
+				{advance: time.Second, check: true, want: []string{"firing 2"}},
+				{ext: "102", status: state.InUse},
+				{check: true},
+				{ext: "102", status: state.NotInUse},
+				{ext: "101", status: state.NotInUse, want: []string{"resolved 1"}},
+				{advance: time.Hour, check: true},
+			},
+		},
+		{
+			name: "rules alert independently",
+			rules: []AlertRuleConfig{
+				{Name: "down", States: []string{"UNAVAILABLE"}},
+				{Name: "any", States: []string{"UNAVAILABLE", "INUSE"}},
+			},
+			steps: []step{
+				{ext: "100", status: state.Unavailable},
+				{check: true, want: []string{"firing 100", "firing 100"}},
+				{ext: "100", status: state.InUse, want: []string{"resolved 100"}},
+				{ext: "100", status: state.NotInUse, want: []string{"resolved 100"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldCache := extensionCache
+			t.Cleanup(func() { extensionCache = oldCache })
+			extensionCache = state.NewCache()
+
+			now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+			e := &AlertEngine{conditions: make(map[string]*alertCondition), now: func() time.Time { return now }}
+			if err := e.Configure(AlertsConfig{Rules: tt.rules}); err != nil {
+				t.Fatal(err)
+			}
+			n := &fakeNotifier{alerts: make(chan Alert, 10)}
+			for _, r := range e.rules {
+				r.notifiers = []Notifier{n}
+			}
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				if s.ext != "" {
+					endpoint := state.Endpoint{Extension: s.ext, Status: s.status, Since: now.Add(-s.since)}
+					extensionCache.Replace(endpoint)
+					e.Observe(endpoint)
+				}
+				if s.check {
+					e.check()
+				}
+				if got := n.received(t, len(s.want)); !reflect.DeepEqual(got, s.want) {
+					t.Fatalf("step %d: alerts %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAlertEngineReconfigure(t *testing.T) {
+	oldCache := extensionCache
+	t.Cleanup(func() { extensionCache = oldCache })
+	extensionCache = state.NewCache()
+
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	e := &AlertEngine{conditions: make(map[string]*alertCondition), now: func() time.Time { return now }}
+	n := &fakeNotifier{alerts: make(chan Alert, 10)}
+	configure := func(rules ...AlertRuleConfig) {
+		t.Helper()
+		if err := e.Configure(AlertsConfig{Rules: rules}); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range e.rules {
+			r.notifiers = []Notifier{n}
+		}
+	}
+	down := AlertRuleConfig{Name: "down", States: []string{"UNAVAILABLE"}, For: time.Minute}
+	configure(down)
+
+	endpoint := state.Endpoint{Extension: "100", Status: state.Unavailable, Since: now}
+	extensionCache.Replace(endpoint)
+	e.Observe(endpoint)
+	now = now.Add(time.Minute)
+	e.check()
+	n.received(t, 1)
+
+	// An unchanged rule keeps its firing condition, so it does not fire again
+	configure(down, AlertRuleConfig{Name: "other", States: []string{"RINGING"}})
+	e.check()
+	n.received(t, 0)
+
+	// A changed rule starts over, picking up the extension from the cache
+	down.For = 2 * time.Minute
+	configure(down)
+	e.check()
+	n.received(t, 0)
+	now = now.Add(time.Minute)
+	e.check()
+	if got := n.received(t, 1); got[0] != "firing 100" {
+		t.Errorf("after changing the rule got %v", got)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Alert
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Api-Key")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path == "/fail" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	a := Alert{Rule: "down", Status: "firing", Extension: "100", State: state.Unavailable, Message: "[down] Extension 100 has been Unavailable for 5m0s"}
+	n, err := newNotifier(NotifierConfig{Name: "hook", Type: "webhook", URL: srv.URL + "/ok", Headers: map[string]string{"X-Api-Key": "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if got.Message != a.Message || got.State != a.State || header != "secret" {
+		t.Errorf("received %+v with key %q", got, header)
+	}
+
+	n, _ = newNotifier(NotifierConfig{Name: "hook", Type: "webhook", URL: srv.URL + "/fail"})
+	if err := n.Notify(context.Background(), a); err == nil {
+		t.Error("no error for a 503 response")
+	}
+}
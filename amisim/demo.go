@@ -0,0 +1,93 @@
+package amisim
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// DemoEndpoint is an extension that Demo makes calls on
+type DemoEndpoint struct {
+	Name     string
+	CallerID string
+}
+
+// DemoEndpoints are the extensions Demo uses. The five-digit ones are
+// visible without logging in.
+var DemoEndpoints = []DemoEndpoint{
+	{"101", "Reception"},
+	{"102", "Sales 1"},
+	{"103", "Sales 2"},
+	{"104", "Support 1"},
+	{"105", "Support 2"},
+	{"106", "Accounts"},
+	{"107", "Warehouse"},
+	{"108", "Manager"},
+	{"20001", "Lobby phone"},
+	{"20002", "Meeting room"},
+}
+
+// demoMoves lists, for each state, the states a phone may move to next
+// and how likely each one is
+var demoMoves = map[string][]struct {
+	to     string
+	weight int
+}{
+	"NOT_INUSE":   {{"RINGING", 6}, {"INUSE", 3}, {"UNAVAILABLE", 1}},
+	"RINGING":     {{"INUSE", 7}, {"NOT_INUSE", 3}},
+	"INUSE":       {{"NOT_INUSE", 6}, {"ONHOLD", 2}, {"RINGINUSE", 1}, {"BUSY", 1}},
+	"BUSY":        {{"INUSE", 1}, {"NOT_INUSE", 1}},
+	"ONHOLD":      {{"INUSE", 7}, {"NOT_INUSE", 3}},
+	"RINGINUSE":   {{"INUSE", 1}},
+	"UNAVAILABLE": {{"NOT_INUSE", 1}},
+}
+
+// Demo lists DemoEndpoints and sets their first states, then makes up
+// calls on them in the background until ctx ends, changing one phone's
+// state every interval. The endpoints are listed when Demo returns.
+func (s *Server) Demo(ctx context.Context, interval time.Duration) {
+	states := make(map[string]string)
+	for i, e := range DemoEndpoints {
+		s.AddEndpoint(e.Name, e.CallerID)
+		state := "NOT_INUSE"
+		// Start with one phone switched off
+		if i == len(DemoEndpoints)-1 {
+			state = "UNAVAILABLE"
+		}
+		states[e.Name] = state
+		s.SetDeviceState("PJSIP/"+e.Name, state)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			e := DemoEndpoints[rand.IntN(len(DemoEndpoints))]
+			next := demoNext(states[e.Name])
+			states[e.Name] = next
+			s.SetDeviceState("PJSIP/"+e.Name, next)
+		}
+	}()
+}
+
+// demoNext picks a phone's next state at random
+func demoNext(state string) string {
+	moves := demoMoves[state]
+	total := 0
+	for _, m := range moves {
+		total += m.weight
+	}
+	n := rand.IntN(total)
+	for _, m := range moves {
+		if n < m.weight {
+			return m.to
+		}
+		n -= m.weight
+	}
+	return state
+}
@@ -0,0 +1,86 @@
+package amisim
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Record is one captured AMI event. Captures are JSON Lines files with one
+// record per line:
+//
+//	{"time":"2024-05-01T09:30:00.123Z","event":{"Event":"DeviceStateChange","Device":"PJSIP/101","State":"INUSE"}}
+type Record struct {
+	Time  time.Time         `json:"time"`
+	Event map[string]string `json:"event"`
+}
+
+// ReadCapture reads the records of a capture, skipping blank lines
+func ReadCapture(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// LoadCapture reads the records of a capture file
+func LoadCapture(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return records, nil
+}
+
+// Replay emits the events of a capture, keeping the time between them
+// divided by speed: 1 is real time, 10 is ten times faster and 0 sends
+// everything at once. Events that answered the capturing client's own
+// actions, such as the DeviceState list at startup, are not sent; their
+// device states are only remembered for DeviceStateList. Replay returns
+// early if ctx ends.
+func (s *Server) Replay(ctx context.Context, records []Record, speed float64) error {
+	log.Printf("Simulated AMI: replaying %d events at %gx", len(records), speed)
+	var last time.Time
+	for _, record := range records {
+		if speed > 0 && !last.IsZero() && record.Time.After(last) {
+			select {
+			case <-time.After(time.Duration(float64(record.Time.Sub(last)) / speed)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if !record.Time.IsZero() {
+			last = record.Time
+		}
+
+		if record.Event["ActionID"] != "" {
+			s.observe(record.Event)
+			continue
+		}
+		s.Emit(record.Event)
+	}
+	return nil
+}
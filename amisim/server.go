@@ -0,0 +1,412 @@
+// Package amisim is a simulated Asterisk for tests and demos. Its Server
+// speaks enough of the Asterisk Manager Interface (AMI) TCP protocol for
+// sipblf: Login, Logoff, Ping, DeviceStateList, PJSIPShowEndpoints and
+// PJSIPShowEndpoint. Events are sent with Emit, replayed from a capture
+// with Replay, or made up by Demo.
+package amisim
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// banner is sent to every client on connect, as Asterisk does
+const banner = "Asterisk Call Manager/5.0.1\r\n"
+
+// Server is a simulated Asterisk. It remembers the last state sent for
+// each device, so clients that connect late get the current states from
+// DeviceStateList.
+type Server struct {
+	username string
+	secret   string
+	ln       net.Listener
+
+	mu      sync.Mutex
+	clients map[*client]bool
+	// devices holds the last state of each device, as an Asterisk state
+	// name such as NOT_INUSE
+	devices map[string]string
+	// endpoints holds the caller ID of each PJSIP endpoint
+	endpoints map[string]string
+}
+
+// client is one logged-in connection
+type client struct {
+	conn net.Conn
+	out  chan []byte
+	// ready is closed when the client sends its first action after logging
+	// in. Some clients, including amigo, read the login response through a
+	// buffer of their own and would lose anything sent before they have
+	// finished with it, so nothing else is written until then.
+	ready     chan struct{}
+	readyOnce sync.Once
+	closed    chan struct{}
+	once      sync.Once
+	// stopped is closed when the writer returns
+	stopped chan struct{}
+}
+
+// Listen starts a server on addr, e.g. 127.0.0.1:0 for any free port.
+// Clients must log in with username and secret.
+func Listen(addr, username, secret string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	s := &Server{
+		username:  username,
+		secret:    secret,
+		ln:        ln,
+		clients:   make(map[*client]bool),
+		devices:   make(map[string]string),
+		endpoints: make(map[string]string),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() *net.TCPAddr {
+	return s.ln.Addr().(*net.TCPAddr)
+}
+
+// Close stops listening and disconnects every client
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.clients {
+		c.close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// Clients returns the number of logged-in clients
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// AddEndpoint lists a PJSIP endpoint with a caller ID name, as shown by
+// PJSIPShowEndpoints and PJSIPShowEndpoint
+func (s *Server) AddEndpoint(name, callerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints[name] = callerID
+}
+
+// SetDeviceState sends a DeviceStateChange event, e.g. for PJSIP/101 and
+// INUSE
+func (s *Server) SetDeviceState(device, state string) {
+	s.Emit(map[string]string{"Event": "DeviceStateChange", "Device": device, "State": state})
+}
+
+// Emit sends an event to every logged-in client. Device state events also
+// update the states returned by DeviceStateList. A client gets its events
+// once it has sent an action after logging in, as sipblf does at once.
+// Emit waits for a client that is not keeping up rather than dropping its
+// events, so the lock is released before sending.
+func (s *Server) Emit(event map[string]string) {
+	s.observe(event)
+	msg := encode(event)
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.send(msg)
+	}
+	slog.Debug("Simulated AMI event", "event", event["Event"], "clients", len(clients))
+}
+
+// observe records the device state carried by an event, if any
+func (s *Server) observe(event map[string]string) {
+	if e := event["Event"]; e != "DeviceStateChange" && e != "DeviceState" {
+		return
+	}
+	if device := event["Device"]; device != "" {
+		s.mu.Lock()
+		s.devices[device] = event["State"]
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// serve runs one connection: the login, then actions until the client
+// logs off or disconnects
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte(banner)); err != nil {
+		return
+	}
+	r := bufio.NewReader(conn)
+
+	var c *client
+	for {
+		action, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		name := strings.ToLower(action["Action"])
+		if c == nil {
+			// Only Login is allowed before logging in
+			if name != "login" {
+				conn.Write(encode(response(action, "Error", "Message", "Permission denied")))
+				continue
+			}
+			if !s.authenticate(action) {
+				log.Printf("Simulated AMI: login failed for %q from %s", action["Username"], conn.RemoteAddr())
+				conn.Write(encode(response(action, "Error", "Message", "Authentication failed")))
+				return
+			}
+			if _, err := conn.Write(encode(response(action, "Success", "Message", "Authentication accepted"))); err != nil {
+				return
+			}
+			c = s.register(conn)
+			defer s.unregister(c)
+			c.send(encode(map[string]string{"Event": "FullyBooted", "Privilege": "system,all", "Status": "Fully Booted"}))
+			continue
+		}
+		c.readyOnce.Do(func() { close(c.ready) })
+		if name == "logoff" {
+			c.send(encode(response(action, "Goodbye", "Message", "Thanks for all the fish.")))
+			c.hangUp()
+			break
+		}
+		s.handle(c, name, action)
+	}
+}
+
+func (s *Server) authenticate(action map[string]string) bool {
+	user := subtle.ConstantTimeCompare([]byte(action["Username"]), []byte(s.username))
+	secret := subtle.ConstantTimeCompare([]byte(action["Secret"]), []byte(s.secret))
+	return user&secret == 1
+}
+
+// register adds a logged-in client and starts its writer
+func (s *Server) register(conn net.Conn) *client {
+	c := &client{
+		conn:    conn,
+		out:     make(chan []byte, 1000),
+		ready:   make(chan struct{}),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	go c.write()
+	slog.Debug("Simulated AMI client logged in", "client", conn.RemoteAddr())
+	return c
+}
+
+func (s *Server) unregister(c *client) {
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
+	c.close()
+	slog.Debug("Simulated AMI client disconnected", "client", c.conn.RemoteAddr())
+}
+
+// handle answers one action from a logged-in client
+func (s *Server) handle(c *client, name string, action map[string]string) {
+	switch name {
+	case "ping":
+		now := time.Now()
+		c.send(encode(response(action, "Success",
+			"Ping", "Pong",
+			"Timestamp", fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000))))
+
+	case "devicestatelist":
+		s.mu.Lock()
+		devices := make([]string, 0, len(s.devices))
+		for device := range s.devices {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		events := make([]map[string]string, 0, len(devices))
+		for _, device := range devices {
+			events = append(events, map[string]string{"Event": "DeviceState", "Device": device, "State": s.devices[device]})
+		}
+		s.mu.Unlock()
+		s.sendList(c, action, "Device State Changes will follow", events, "DeviceStateListComplete")
+
+	case "pjsipshowendpoints":
+		s.mu.Lock()
+		names := make([]string, 0, len(s.endpoints))
+		for name := range s.endpoints {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		events := make([]map[string]string, 0, len(names))
+		for _, name := range names {
+			events = append(events, map[string]string{"Event": "EndpointList", "ObjectType": "endpoint", "ObjectName": name})
+		}
+		s.sendList(c, action, "A listing of Endpoints follows, presence separate", events, "EndpointListComplete")
+
+	case "pjsipshowendpoint":
+		name := action["Endpoint"]
+		s.mu.Lock()
+		callerID, ok := s.endpoints[name]
+		s.mu.Unlock()
+		if !ok {
+			c.send(encode(response(action, "Error", "Message", "Unable to retrieve endpoint "+name)))
+			return
+		}
+		events := []map[string]string{{
+			"Event":      "EndpointDetail",
+			"ObjectType": "endpoint",
+			"ObjectName": name,
+			"Callerid":   fmt.Sprintf("%q <%s>", callerID, name),
+		}}
+		s.sendList(c, action, "Following are Events for each object associated with the Endpoint", events, "EndpointDetailComplete")
+
+	default:
+		c.send(encode(response(action, "Error", "Message", "Invalid/unknown command")))
+	}
+}
+
+// sendList answers a list action: a response, the events carrying the
+// action's ActionID, then the completion event
+func (s *Server) sendList(c *client, action map[string]string, message string, events []map[string]string, complete string) {
+	c.send(encode(response(action, "Success", "EventList", "start", "Message", message)))
+	for _, event := range events {
+		if id := action["ActionID"]; id != "" {
+			event["ActionID"] = id
+		}
+		c.send(encode(event))
+	}
+	done := map[string]string{"Event": complete, "EventList": "Complete", "ListItems": fmt.Sprint(len(events))}
+	if id := action["ActionID"]; id != "" {
+		done["ActionID"] = id
+	}
+	c.send(encode(done))
+}
+
+// send queues a message for the client, waiting while its queue is full
+// so that a slow client sees every message, as it would from Asterisk.
+// Messages for a closed client are discarded.
+func (c *client) send(msg []byte) {
+	select {
+	case c.out <- msg:
+	case <-c.closed:
+	}
+}
+
+// hangUp closes the connection once the messages already queued are sent
+func (c *client) hangUp() {
+	select {
+	case c.out <- nil:
+	case <-c.closed:
+	}
+	<-c.stopped
+}
+
+// write sends queued messages once the client is ready for them. A nil
+// message, queued by hangUp, closes the connection.
+func (c *client) write() {
+	defer close(c.stopped)
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return
+	}
+	for {
+		select {
+		case msg := <-c.out:
+			if msg == nil {
+				c.close()
+				return
+			}
+			if _, err := c.conn.Write(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// response builds an action response, echoing the action's ActionID,
+// followed by the given key, value pairs
+func response(action map[string]string, result string, pairs ...string) map[string]string {
+	m := map[string]string{"Response": result}
+	if id := action["ActionID"]; id != "" {
+		m["ActionID"] = id
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		m[pairs[i]] = pairs[i+1]
+	}
+	return m
+}
+
+// encode formats a message for the wire: Response or Event first, then
+// the other keys in order
+func encode(m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if key != "Response" && key != "Event" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range append([]string{"Response", "Event"}, keys...) {
+		if value, ok := m[key]; ok {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, strings.ReplaceAll(value, "\n", " "))
+		}
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// readMessage reads one message, up to the blank line that ends it
+func readMessage(r *bufio.Reader) (map[string]string, error) {
+	m := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(m) == 0 {
+				// Skip stray blank lines between messages
+				continue
+			}
+			return m, nil
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package amisim_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivahaev/amigo"
+
+	"sipblf/amisim"
+	"sipblf/broadcast"
+	"sipblf/ingest"
+	"sipblf/state"
+)
+
+// everything is a broadcast.Viewer that sees every extension in detail
+type everything struct{}
+
+func (everything) CanSee(string) bool { return true }
+func (everything) Detailed() bool     { return true }
+
+// connect starts an amigo client logged in to sim
+func connect(t *testing.T, sim *amisim.Server) *amigo.Amigo {
+	t.Helper()
+	ami := amigo.New(&amigo.Settings{
+		Host:              "127.0.0.1",
+		Port:              strconv.Itoa(sim.Addr().Port),
+		Username:          "sipblf",
+		Password:          "secret",
+		DialTimeout:       time.Second,
+		ReconnectInterval: time.Second,
+	})
+	connected := make(chan struct{}, 1)
+	ami.On("connect", func(string) {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	ami.Connect()
+	t.Cleanup(func() { ami.Close() })
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out connecting to the simulated Asterisk")
+	}
+	return ami
+}
+
+// TestIngest runs a state change from the simulated Asterisk through amigo,
+// the ingester, the cache and the broadcaster to an SSE client
+func TestIngest(t *testing.T) {
+	sim, err := amisim.Listen("127.0.0.1:0", "sipblf", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	// Known before sipblf connects, so it comes from DeviceStateList
+	sim.SetDeviceState("PJSIP/101", "NOT_INUSE")
+
+	cache := state.NewCache()
+	events := broadcast.New()
+	in := ingest.New(cache,
+		ingest.MapperFunc(func(device string) (string, bool) {
+			return strings.CutPrefix(device, "PJSIP/")
+		}),
+		ingest.ListenerFunc(func(device string, previous state.State, endpoint state.Endpoint) {
+			if endpoint.Status != previous {
+				events.BroadcastFilteredEvent(endpoint.Extension, endpoint.Status)
+			}
+		}))
+
+	ami := connect(t, sim)
+	if err := in.LoadStates(ami, 5*time.Second); err != nil {
+		t.Fatalf("LoadStates: %v", err)
+	}
+	if e, _ := cache.Snapshot("101"); e.Status != state.NotInUse {
+		t.Fatalf("101 after DeviceStateList = %s, want %s", e.Status, state.NotInUse)
+	}
+	ami.RegisterHandler("DeviceStateChange", in.HandleEvent)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events.ServeEvents(w, r, "test", everything{}, func() []state.Endpoint {
+			return cache.List(func(string) bool { return true }, true)
+		})
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	stream := bufio.NewScanner(resp.Body)
+	// waitFor reads the stream up to a line, failing if it ends first
+	waitFor := func(want string) {
+		t.Helper()
+		for stream.Scan() {
+			if stream.Text() == want {
+				return
+			}
+		}
+		t.Fatalf("stream ended before %q: %v", want, stream.Err())
+	}
+	waitFor("data: 101 Not in use")
+	waitFor("data: Connected to updates")
+
+	sim.SetDeviceState("PJSIP/101", "INUSE")
+	waitFor("data: 101 In use")
+	if e, _ := cache.Snapshot("101"); e.Status != state.InUse {
+		t.Errorf("101 = %s, want %s", e.Status, state.InUse)
+	}
+
+	sim.SetDeviceState("PJSIP/102", "RINGING")
+	waitFor("data: 102 Ringing")
+}
+
+func TestReplay(t *testing.T) {
+	sim, err := amisim.Listen("127.0.0.1:0", "sipblf", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	records, err := amisim.ReadCapture(strings.NewReader(`
+{"time":"2024-05-01T09:30:00Z","event":{"Event":"DeviceState","Device":"PJSIP/101","State":"INUSE","ActionID":"init"}}
+{"time":"2024-05-01T09:30:01Z","event":{"Event":"DeviceStateChange","Device":"PJSIP/102","State":"RINGING"}}
+{"time":"2024-05-01T09:30:02Z","event":{"Event":"DeviceStateChange","Device":"PJSIP/102","State":"INUSE"}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("read %d records, want 3", len(records))
+	}
+
+	cache := state.NewCache()
+	in := ingest.New(cache, ingest.MapperFunc(func(device string) (string, bool) {
+		return strings.CutPrefix(device, "PJSIP/")
+	}), nil)
+	ami := connect(t, sim)
+	changes := make(chan struct{}, 10)
+	ami.RegisterHandler("DeviceStateChange", func(m map[string]string) {
+		in.HandleEvent(m)
+		changes <- struct{}{}
+	})
+	// Any action lets the simulator start sending events
+	if _, err := ami.Action(map[string]string{"Action": "Ping"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sim.Replay(context.Background(), records, 0); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for replayed events")
+		}
+	}
+	if e, _ := cache.Snapshot("102"); e.Status != state.InUse {
+		t.Errorf("102 = %s, want %s", e.Status, state.InUse)
+	}
+	// Answers to the capturing client's own actions are not sent
+	if _, ok := cache.Snapshot("101"); ok {
+		t.Error("101 was sent, but it answered an action")
+	}
+
+	// ... but their states are listed
+	if err := in.LoadStates(ami, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := cache.Snapshot("101"); e.Status != state.InUse {
+		t.Errorf("101 from DeviceStateList = %s, want %s", e.Status, state.InUse)
+	}
+}
+
+// TestSlowClient checks that a client reading slowly still gets every
+// event, in order, and that closing the server releases a blocked Emit
+func TestSlowClient(t *testing.T) {
+	sim, err := amisim.Listen("127.0.0.1:0", "sipblf", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	conn, err := net.Dial("tcp", sim.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// Log in, then send an action so events start to flow
+	if _, err := conn.Write([]byte("Action: Login\r\nUsername: sipblf\r\nSecret: secret\r\n\r\nAction: Ping\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for sim.Clients() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Many more events than the client's queue holds, sent before it reads
+	const events = 20000
+	emitted := make(chan struct{})
+	go func() {
+		for i := range events {
+			sim.Emit(map[string]string{"Event": "DeviceStateChange", "Device": "PJSIP/" + strconv.Itoa(i), "State": "INUSE"})
+		}
+		close(emitted)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	r := bufio.NewReader(conn)
+	next := 0
+	for next < events {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %d events: %v", next, err)
+		}
+		device, ok := strings.CutPrefix(strings.TrimSpace(line), "Device: PJSIP/")
+		if !ok {
+			continue
+		}
+		if device != strconv.Itoa(next) {
+			t.Fatalf("got device %s, want %d", device, next)
+		}
+		next++
+	}
+	<-emitted
+
+	// A client that stops reading holds up Emit only until the server closes
+	done := make(chan struct{})
+	go func() {
+		for range events {
+			sim.Emit(map[string]string{"Event": "DeviceStateChange", "Device": "PJSIP/100", "State": "INUSE"})
+		}
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sim.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Emit still blocked after Close")
+	}
+}
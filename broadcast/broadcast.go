@@ -0,0 +1,335 @@
+// Package broadcast pushes extension state changes to browsers and other
+// clients as server-sent events. Each client sees only the extensions its
+// Viewer allows.
+package broadcast
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sipblf/state"
+)
+
+// Viewer decides what a client may see
+type Viewer interface {
+	// CanSee reports whether the client may see an extension
+	CanSee(ext string) bool
+	// Detailed reports whether the client may see per-device detail
+	Detailed() bool
+}
+
+// Broadcaster sends server-sent events to connected clients
+type Broadcaster struct {
+	clients map[chan string]*ClientInfo
+	mu      sync.RWMutex
+}
+
+// ClientInfo stores information about a connected client
+type ClientInfo struct {
+	Viewer Viewer
+}
+
+// New creates a broadcaster with no clients
+func New() *Broadcaster {
+	return &Broadcaster{
+		clients: make(map[chan string]*ClientInfo),
+	}
+}
+
+// Subscribe registers a new client channel for receiving events
+func (b *Broadcaster) Subscribe(viewer Viewer) (chan string, func()) {
+	// Increase buffer size to handle bursts of events better
+	events := make(chan string, 100)
+
+	b.mu.Lock()
+	b.clients[events] = &ClientInfo{
+		Viewer: viewer,
+	}
+	b.mu.Unlock()
+
+	// Return the channel and an unsubscribe function
+	return events, func() {
+		b.mu.Lock()
+		delete(b.clients, events)
+		close(events)
+		b.mu.Unlock()
+	}
+}
+
+// ClientCount returns the number of connected clients
+func (b *Broadcaster) ClientCount() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.clients)
+}
+
+// BroadcastEvent sends an event to all connected clients
+func (b *Broadcaster) BroadcastEvent(event string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	activeClients := 0
+	skippedClients := 0
+
+	for client := range b.clients {
+		// Use a timeout for sending to prevent complete blocking
+		select {
+		case client <- event:
+			activeClients++
+		case <-time.After(100 * time.Millisecond):
+			// If we can't send within 100ms, log it and skip
+			skippedClients++
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+
+	if skippedClients > 0 {
+		log.Printf("Warning: Broadcast partially complete: %d active clients, %d skipped", activeClients, skippedClients)
+	} else {
+		slog.Debug("Broadcast complete", "active_clients", activeClients)
+	}
+
+	// Debug: print the event that was broadcast
+	slog.Debug("Broadcast event content", "event", event)
+}
+
+// BroadcastFilteredEvent sends an event to clients whose scope allows them to see the extension
+func (b *Broadcaster) BroadcastFilteredEvent(ext string, s state.State) {
+	eventMsg := StateEvent(ext, s)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	activeClients := 0
+	skippedClients := 0
+	for client, info := range b.clients {
+		// Only send extensions the client is allowed to see
+		if !info.Viewer.CanSee(ext) {
+			continue // Skip this client
+		}
+
+		// Use a timeout for sending to prevent complete blocking
+		select {
+		case client <- eventMsg:
+			activeClients++
+		case <-time.After(100 * time.Millisecond):
+			// If we can't send within 100ms, log it and skip
+			skippedClients++
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+
+	if skippedClients > 0 {
+		log.Printf("Warning: Filtered broadcast partially complete: %d active clients, %d skipped", activeClients, skippedClients)
+	} else {
+		slog.Debug("Filtered broadcast complete", "active_clients", activeClients)
+	}
+
+	// Debug: print the event that was broadcast
+	slog.Debug("Broadcast filtered event", "extension", ext, "state", s)
+}
+
+// BroadcastDescription tells clients that may see ext about its new description
+func (b *Broadcaster) BroadcastDescription(endpoint state.Endpoint) {
+	data, err := json.Marshal(map[string]interface{}{
+		"extension":   endpoint.Extension,
+		"description": endpoint.Description,
+		"status":      endpoint.Status,
+		"metadata":    endpoint.Metadata,
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to encode description event: %v", err)
+		return
+	}
+	eventMsg := fmt.Sprintf("event: description\ndata: %s\n\n", data)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for client, info := range b.clients {
+		if !info.Viewer.CanSee(endpoint.Extension) {
+			continue
+		}
+		select {
+		case client <- eventMsg:
+		case <-time.After(100 * time.Millisecond):
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+	slog.Debug("Broadcast description", "extension", endpoint.Extension, "description", endpoint.Description)
+}
+
+// BroadcastRemoval tells clients that may see ext that it no longer exists
+func (b *Broadcaster) BroadcastRemoval(ext string) {
+	eventMsg := fmt.Sprintf("event: remove\ndata: %s\n\n", ext)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for client, info := range b.clients {
+		if !info.Viewer.CanSee(ext) {
+			continue
+		}
+		select {
+		case client <- eventMsg:
+		case <-time.After(100 * time.Millisecond):
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+	slog.Debug("Broadcast removal", "extension", ext)
+}
+
+// BroadcastDevices gives authenticated clients the per-device detail of ext
+func (b *Broadcaster) BroadcastDevices(ext string, devices []state.DeviceState) {
+	eventMsg := DevicesEvent(ext, devices)
+	if eventMsg == "" {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for client, info := range b.clients {
+		if !info.Viewer.Detailed() {
+			continue
+		}
+		select {
+		case client <- eventMsg:
+		case <-time.After(100 * time.Millisecond):
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+	slog.Debug("Broadcast devices", "extension", ext, "devices", len(devices))
+}
+
+// BroadcastTimes tells clients that may see the endpoint when it entered its
+// state and when it was last reachable
+func (b *Broadcaster) BroadcastTimes(endpoint state.Endpoint) {
+	eventMsg := TimesEvent(endpoint)
+	if eventMsg == "" {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for client, info := range b.clients {
+		if !info.Viewer.CanSee(endpoint.Extension) {
+			continue
+		}
+		select {
+		case client <- eventMsg:
+		case <-time.After(100 * time.Millisecond):
+			log.Printf("Warning: Client buffer full, message skipped")
+		}
+	}
+}
+
+// TimesEvent formats the times event for an endpoint
+func TimesEvent(endpoint state.Endpoint) string {
+	// Unknown times are sent as null
+	orNil := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"extension": endpoint.Extension,
+		"since":     orNil(endpoint.Since),
+		"last_seen": orNil(endpoint.LastSeen),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to encode times event: %v", err)
+		return ""
+	}
+	return fmt.Sprintf("event: times\ndata: %s\n\n", data)
+}
+
+// StateEvent formats the unnamed event that carries an extension's state
+func StateEvent(ext string, s state.State) string {
+	return fmt.Sprintf("data: %s %s\n\n", ext, s)
+}
+
+// DevicesEvent formats the devices event for an extension
+func DevicesEvent(ext string, devices []state.DeviceState) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"extension": ext,
+		"devices":   devices,
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to encode devices event: %v", err)
+		return ""
+	}
+	return fmt.Sprintf("event: devices\ndata: %s\n\n", data)
+}
+
+// ServeEvents streams events to one client until it disconnects. It first
+// sends the state of each endpoint initial returns, then "Connected to updates",
+// then every broadcast the viewer may see, with a keep-alive comment every
+// 30 seconds. clientIP identifies the client in logs.
+func (b *Broadcaster) ServeEvents(w http.ResponseWriter, r *http.Request, clientIP string, viewer Viewer, initial func() []state.Endpoint) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// Subscribe before sending the initial states so no change is missed
+	events, unsubscribe := b.Subscribe(viewer)
+	defer unsubscribe()
+
+	slog.Debug("Sending initial states", "client_ip", clientIP)
+	for _, endpoint := range initial() {
+		slog.Debug("Sending initial state", "client_ip", clientIP, "extension", endpoint.Extension, "status", endpoint.Status)
+		fmt.Fprint(w, StateEvent(endpoint.Extension, endpoint.Status))
+		fmt.Fprint(w, TimesEvent(endpoint))
+		// Authenticated clients also get each device's state
+		if viewer.Detailed() && len(endpoint.Devices) > 0 {
+			fmt.Fprint(w, DevicesEvent(endpoint.Extension, endpoint.Devices))
+		}
+	}
+	flusher.Flush()
+	slog.Debug("Finished sending initial states", "client_ip", clientIP)
+
+	// Send initial connection message
+	initialMsg := "data: Connected to updates\n\n"
+	fmt.Fprint(w, initialMsg)
+	flusher.Flush()
+	slog.Debug("Sent initial message", "client_ip", clientIP, "message", initialMsg)
+
+	// Start keep-alive ticker
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	// Handle events and keep-alive
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Client %s context done", clientIP)
+			return
+		case event := <-events:
+			// Check if this is a direct broadcast message (already formatted as SSE)
+			if strings.HasPrefix(event, "data: ") || strings.HasPrefix(event, "event: ") {
+				slog.Debug("Forwarding direct SSE message", "client_ip", clientIP, "event", event)
+				fmt.Fprint(w, event)
+				flusher.Flush()
+				slog.Debug("Sent direct update", "client_ip", clientIP)
+			}
+		case <-ticker.C:
+			// Send keep-alive message as a comment (just a colon)
+			msg := ":\n\n"
+			fmt.Fprint(w, msg)
+			flusher.Flush()
+			slog.Debug("Sent keep-alive", "client_ip", clientIP)
+		}
+	}
+}
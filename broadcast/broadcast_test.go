@@ -0,0 +1,166 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sipblf/state"
+)
+
+// viewer sees extensions of five or more characters, or everything if all is set
+type viewer struct {
+	all bool
+}
+
+func (v viewer) CanSee(ext string) bool {
+	return v.all || len(ext) >= 5
+}
+
+func (v viewer) Detailed() bool {
+	return v.all
+}
+
+// received drains the events already queued on ch
+func received(ch chan string) []string {
+	var events []string
+	for {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestViewerFiltering(t *testing.T) {
+	devices := []state.DeviceState{{Device: "PJSIP/101", Status: state.InUse}}
+	tests := []struct {
+		name       string
+		broadcast  func(b *Broadcaster)
+		wantPublic bool
+		wantAll    bool
+	}{
+		{"private state", func(b *Broadcaster) { b.BroadcastFilteredEvent("101", state.InUse) }, false, true},
+		{"public state", func(b *Broadcaster) { b.BroadcastFilteredEvent("20001", state.InUse) }, true, true},
+		{"private description", func(b *Broadcaster) {
+			b.BroadcastDescription(state.Endpoint{Extension: "101", Description: "Reception"})
+		}, false, true},
+		{"public description", func(b *Broadcaster) {
+			b.BroadcastDescription(state.Endpoint{Extension: "20001", Description: "Lobby"})
+		}, true, true},
+		{"private removal", func(b *Broadcaster) { b.BroadcastRemoval("101") }, false, true},
+		{"public removal", func(b *Broadcaster) { b.BroadcastRemoval("20001") }, true, true},
+		{"private times", func(b *Broadcaster) {
+			b.BroadcastTimes(state.Endpoint{Extension: "101", Since: time.Now()})
+		}, false, true},
+		{"public times", func(b *Broadcaster) {
+			b.BroadcastTimes(state.Endpoint{Extension: "20001", Since: time.Now()})
+		}, true, true},
+		// Device detail is for detailed viewers only, whatever the extension
+		{"devices of a public extension", func(b *Broadcaster) { b.BroadcastDevices("20001", devices) }, false, true},
+		{"unfiltered event", func(b *Broadcaster) { b.BroadcastEvent("event: reload\ndata: config\n\n") }, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			public, unsubscribePublic := b.Subscribe(viewer{})
+			defer unsubscribePublic()
+			all, unsubscribeAll := b.Subscribe(viewer{all: true})
+			defer unsubscribeAll()
+
+			tt.broadcast(b)
+			if got := len(received(public)) > 0; got != tt.wantPublic {
+				t.Errorf("public viewer received = %v, want %v", got, tt.wantPublic)
+			}
+			if got := len(received(all)) > 0; got != tt.wantAll {
+				t.Errorf("detailed viewer received = %v, want %v", got, tt.wantAll)
+			}
+		})
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	b := New()
+	_, unsubscribe := b.Subscribe(viewer{})
+	if n := b.ClientCount(); n != 1 {
+		t.Fatalf("ClientCount = %d, want 1", n)
+	}
+	unsubscribe()
+	if n := b.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d after unsubscribe, want 0", n)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	initial := []state.Endpoint{{
+		Extension: "101",
+		Status:    state.InUse,
+		Devices:   []state.DeviceState{{Device: "PJSIP/101", Status: state.InUse}},
+	}}
+	tests := []struct {
+		name        string
+		viewer      viewer
+		wantDevices bool
+	}{
+		{"detailed viewer gets devices", viewer{all: true}, true},
+		{"other viewer does not", viewer{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b.ServeEvents(w, r, "test", tt.viewer, func() []state.Endpoint { return initial })
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+
+			// Read up to the connected message
+			var stream []string
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				line := scanner.Text()
+				stream = append(stream, line)
+				if line == "data: Connected to updates" {
+					break
+				}
+			}
+			got := strings.Join(stream, "\n")
+			if !strings.Contains(got, "data: 101 In use") {
+				t.Errorf("initial state missing from %q", got)
+			}
+			if has := strings.Contains(got, "event: devices"); has != tt.wantDevices {
+				t.Errorf("devices event sent = %v, want %v", has, tt.wantDevices)
+			}
+
+			// Broadcasts follow, filtered by the viewer
+			b.BroadcastFilteredEvent("102", state.Ringing)
+			b.BroadcastFilteredEvent("20001", state.Ringing)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if strings.HasPrefix(line, "data: 102") && !tt.viewer.all {
+					t.Errorf("viewer received hidden extension: %q", line)
+				}
+				if line == "data: 20001 Ringing" {
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"sipblf/amisim"
+)
+
+// AMICapture records every AMI event received to a JSON Lines file that
+// --demo-capture and amisim can replay. Passwords are redacted. When the
+// file reaches max_size_mb it becomes <path>.1, older files move up to
+// <path>.<max_files>, and a new file is started.
+type AMICapture struct {
+	mu       sync.Mutex
+	settings CaptureConfig
+	enabled  bool
+	file     *os.File
+	size     int64
+}
+
+// CaptureStatus reports what the capture is doing
+type CaptureStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	MaxSizeMB int    `json:"max_size_mb"`
+	MaxFiles  int    `json:"max_files"`
+}
+
+// amiCapture records AMI events while enabled
+var amiCapture = &AMICapture{}
+
+// captureSecretKeys are redacted from captured events: any key containing
+// one of these, ignoring case
+var captureSecretKeys = []string{"secret", "password", "passwd", "md5", "challenge", "expectedresponse", "receivedhash"}
+
+// Configure applies new settings, starting or stopping the capture as
+// capture.enabled says
+func (c *AMICapture) Configure(settings CaptureConfig) error {
+	apply, err := c.Prepare(settings)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare opens the capture file for new settings, if they enable the
+// capture, and returns a function that switches to them. The file stays
+// open until then, so nothing that can fail may come between the two.
+func (c *AMICapture) Prepare(settings CaptureConfig) (func(), error) {
+	var f *os.File
+	var size int64
+	if settings.Enabled {
+		var err error
+		if f, size, err = openCapture(settings.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		wasEnabled := c.enabled
+		c.close()
+		c.settings = settings
+		c.file, c.size, c.enabled = f, size, f != nil
+		switch {
+		case c.enabled:
+			log.Printf("AMI capture started, writing to %s", settings.Path)
+		case wasEnabled:
+			log.Printf("AMI capture stopped")
+		}
+	}, nil
+}
+
+// SetEnabled starts or stops the capture until the next restart, or a
+// reload that changes the capture settings
+func (c *AMICapture) SetEnabled(enabled bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setEnabled(enabled)
+}
+
+func (c *AMICapture) setEnabled(enabled bool) error {
+	if enabled == c.enabled {
+		return nil
+	}
+	if !enabled {
+		c.close()
+		c.enabled = false
+		log.Printf("AMI capture stopped")
+		return nil
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.enabled = true
+	log.Printf("AMI capture started, writing to %s", c.settings.Path)
+	return nil
+}
+
+// Status returns the capture's state and settings
+func (c *AMICapture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CaptureStatus{
+		Enabled:   c.enabled,
+		Path:      c.settings.Path,
+		SizeBytes: c.size,
+		MaxSizeMB: c.settings.MaxSizeMB,
+		MaxFiles:  c.settings.MaxFiles,
+	}
+}
+
+// Record writes an event if the capture is enabled. If writing fails the
+// capture stops rather than log an error for every event.
+func (c *AMICapture) Record(event map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return
+	}
+
+	// amigo adds a sequence number and the time received to every event
+	t, err := time.Parse(time.RFC3339Nano, event["TimeReceived"])
+	if err != nil {
+		t = time.Now()
+	}
+	fields := make(map[string]string, len(event))
+	for key, value := range event {
+		if key == "#" || key == "TimeReceived" {
+			continue
+		}
+		fields[key] = redactCaptured(key, value)
+	}
+	line, err := json.Marshal(amisim.Record{Time: t.UTC(), Event: fields})
+	if err != nil {
+		log.Printf("Warning: Failed to encode captured AMI event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if c.size > 0 && c.size+int64(len(line)) > int64(c.settings.MaxSizeMB)<<20 {
+		if err := c.rotate(); err != nil {
+			log.Printf("Warning: Failed to rotate AMI capture, stopping it: %v", err)
+			c.close()
+			c.enabled = false
+			return
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		log.Printf("Warning: Failed to write AMI capture, stopping it: %v", err)
+		c.close()
+		c.enabled = false
+	}
+}
+
+// redactCaptured hides passwords, including the AMI password wherever it
+// appears
+func redactCaptured(key, value string) string {
+	lower := strings.ToLower(key)
+	for _, secret := range captureSecretKeys {
+		if strings.Contains(lower, secret) {
+			return "****"
+		}
+	}
+	// Short passwords would redact unrelated text
+	if pass := currentConfig().AMI.Pass; len(pass) >= 4 {
+		value = strings.ReplaceAll(value, pass, "****")
+	}
+	return value
+}
+
+// open appends to the capture file, creating it if needed. The caller must
+// hold c.mu.
+func (c *AMICapture) open() error {
+	if c.file != nil {
+		return nil
+	}
+	f, size, err := openCapture(c.settings.Path)
+	if err != nil {
+		return err
+	}
+	c.file, c.size = f, size
+	return nil
+}
+
+// openCapture opens a capture file for appending and returns its size
+func openCapture(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open AMI capture: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to open AMI capture: %v", err)
+	}
+	return f, info.Size(), nil
+}
+
+// close closes the capture file, if open. The caller must hold c.mu.
+func (c *AMICapture) close() {
+	if c.file == nil {
+		return
+	}
+	if err := c.file.Close(); err != nil {
+		log.Printf("Warning: Failed to close AMI capture: %v", err)
+	}
+	c.file, c.size = nil, 0
+}
+
+// rotate shifts the capture files up by one, dropping the oldest, and
+// starts a new file. The caller must hold c.mu.
+func (c *AMICapture) rotate() error {
+	c.close()
+	path, keep := c.settings.Path, c.settings.MaxFiles
+	if keep == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, keep))
+		for i := keep - 1; i >= 1; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	slog.Debug("Rotated AMI capture", "path", path)
+	return c.open()
+}
+
+// registerCaptureRoutes adds the admin API for the AMI capture
+func registerCaptureRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/capture", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if ingestOnly(w, "AMI capture") {
+			return
+		}
+		writeJSON(w, http.StatusOK, amiCapture.Status())
+	}))
+
+	mux.HandleFunc("POST /api/admin/capture", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `Body must be {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+			return
+		}
+		if ingestOnly(w, "AMI capture") {
+			return
+		}
+		if err := amiCapture.SetEnabled(*req.Enabled); err != nil {
+			slog.Error("Failed to switch AMI capture", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("AMI capture switched", "audit", "capture", "enabled", *req.Enabled, "client_ip", clientIP(r))
+		writeJSON(w, http.StatusOK, amiCapture.Status())
+	}))
+}
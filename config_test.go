@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePaths(t *testing.T) {
+	abs := filepath.Join(t.TempDir(), "history.db")
+	c := defaultConfig()
+	c.DataDir = "/var/lib/sipblf"
+	c.History.Path = abs
+	c.Webhooks.DeadLetterPath = ""
+	c.resolvePaths()
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"default session path", c.Session.Path, "/var/lib/sipblf/sessions.db"},
+		{"default tokens file", c.Tokens.File, "/var/lib/sipblf/tokens.json"},
+		{"default capture path", c.Capture.Path, "/var/lib/sipblf/ami-capture.jsonl"},
+		{"absolute path", c.History.Path, abs},
+		{"empty path", c.Webhooks.DeadLetterPath, ""},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := defaultConfig()
+	c.Server.AdminPassword = "admin-secret"
+	c.Redis.URL = "redis://:redis-secret@redis:6379/0"
+	c.Session.DSN = "sipblf:session-secret@tcp(db:3306)/sipblf"
+	c.Alerts.Notifiers = []NotifierConfig{
+		{Name: "slack", Type: "webhook", URL: "https://hooks.slack.com/services/T000/B000/slack-secret"},
+		{Name: "mail", Type: "smtp", Password: "smtp-secret"},
+	}
+	c.Webhooks.Subscriptions = []WebhookSubscriptionConfig{
+		{Name: "crm", URL: "https://crm.example.com/hook?token=query-secret", Secret: "hmac-secret"},
+	}
+	r := c.Redacted()
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"admin password", r.Server.AdminPassword, "********"},
+		{"redis URL", r.Redis.URL, "redis://:xxxxx@redis:6379/0"},
+		{"session DSN", r.Session.DSN, "sipblf:********@tcp(db:3306)/sipblf"},
+		{"alert webhook URL", r.Alerts.Notifiers[0].URL, "https://hooks.slack.com/********"},
+		{"smtp password", r.Alerts.Notifiers[1].Password, "********"},
+		{"subscription URL", r.Webhooks.Subscriptions[0].URL, "https://crm.example.com/********"},
+		{"subscription secret", r.Webhooks.Subscriptions[0].Secret, "********"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if c.Alerts.Notifiers[0].URL != "https://hooks.slack.com/services/T000/B000/slack-secret" {
+		t.Error("Redacted changed the original configuration")
+	}
+}
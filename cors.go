@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CORSPolicy holds the set of origins allowed to make cross-origin requests
+type CORSPolicy struct {
+	mu       sync.RWMutex
+	origins  map[string]bool
+	allowAll bool
+}
+
+// NewCORSPolicy builds a policy from an origin allow-list such as
+// "https://intranet.example.com". A "*" entry allows any origin but never
+// with credentials. An empty list allows none.
+func NewCORSPolicy(list []string) *CORSPolicy {
+	p := &CORSPolicy{}
+	p.Update(list)
+	return p
+}
+
+// Update replaces the allow-list
+func (p *CORSPolicy) Update(list []string) {
+	origins := make(map[string]bool)
+	allowAll := false
+	for _, origin := range list {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			allowAll = true
+		default:
+			origins[strings.ToLower(origin)] = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.origins = origins
+	p.allowAll = allowAll
+}
+
+// Allowed reports whether origin may access the service. It is also the
+// check to use for the Origin header of any WebSocket upgrade.
+func (p *CORSPolicy) Allowed(origin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.allowAll || p.origins[strings.ToLower(origin)]
+}
+
+// credentialed reports whether origin is explicitly listed and so may send cookies
+func (p *CORSPolicy) credentialed(origin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.origins[strings.ToLower(origin)]
+}
+
+// Middleware adds CORS headers for allowed origins and answers preflight requests
+func (p *CORSPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !p.Allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p.credentialed(origin) {
+			// Listed origins get credentialed access for the session cookie
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		// Answer preflight requests directly
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+csrfHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+)
+
+// csrfHeader is the request header carrying the CSRF token on mutating requests
+const csrfHeader = "X-CSRF-Token"
+
+// csrfCookie holds the CSRF token of visitors without a session, so that
+// anonymous page views do not create sessions
+const csrfCookie = "sipblf_csrf"
+
+// csrfToken returns the CSRF token for the request: the session's if it has
+// one, otherwise a double-submit token kept in a cookie, set if needed
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if token := sessionManager.GetString(r.Context(), "csrf_token"); token != "" {
+		return token
+	}
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token, err := randomString(32)
+	if err != nil {
+		slog.Error("Failed to generate CSRF token", "error", err)
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   sessionManager.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// expectedCSRFToken returns the token a mutating request must present. A
+// session's own token wins over the cookie, which a sibling site might set.
+func expectedCSRFToken(r *http.Request) string {
+	if token := sessionManager.GetString(r.Context(), "csrf_token"); token != "" {
+		return token
+	}
+	if c, err := r.Cookie(csrfCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// isHTTPS reports whether the client connected over HTTPS, directly or via a
+// TLS-terminating proxy. X-Forwarded-Proto is only believed from a trusted
+// proxy, like the forwarding headers in clientIP.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return isTrustedProxy(remoteIP(r)) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// csrfProtect requires a valid CSRF token on every state-changing request
+// that relies on cookies. Requests with a valid API token carry no ambient
+// credentials and are passed through; handlers then authorize them from the
+// token alone (see isAdmin).
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			if _, err := requestToken(r); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A Secure cookie sent over plain HTTP is silently dropped by the
+		// browser, so the session (and its CSRF token) can never stick
+		if sessionManager.Cookie.Secure && !isHTTPS(r) {
+			slog.Warn("Rejected cookie-authenticated request over plain HTTP", "path", r.URL.Path, "client_ip", clientIP(r))
+			http.Error(w, "This server requires HTTPS: the session cookie is marked Secure and will not be stored over plain HTTP. "+
+				"Use HTTPS, or set server.mode to development (APP_MODE) or server.cookie_secure to false (COOKIE_SECURE) for local testing.", http.StatusBadRequest)
+			return
+		}
+
+		expected := expectedCSRFToken(r)
+		got := r.Header.Get(csrfHeader)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+			slog.Warn("CSRF token mismatch", "path", r.URL.Path, "client_ip", clientIP(r))
+			http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"sipblf/amisim"
+)
+
+// Credentials sipblf uses to log in to the simulated Asterisk in demo mode
+const (
+	demoUser   = "demo"
+	demoSecret = "demo"
+)
+
+// demoPause separates rounds of a capture replayed in a loop
+const demoPause = 5 * time.Second
+
+// startDemo starts the simulated Asterisk used by -demo on a free local
+// port and drives it with made-up calls, or with a capture replayed in a loop
+func startDemo(opts *Options) error {
+	var records []amisim.Record
+	var err error
+	if opts.DemoCapture != "" {
+		records, err = amisim.LoadCapture(opts.DemoCapture)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Used if no admin password is configured; kept for the whole run so
+	// reloads do not change it
+	opts.demoPassword, err = randomString(12)
+	if err != nil {
+		return err
+	}
+
+	sim, err := amisim.Listen("127.0.0.1:0", demoUser, demoSecret)
+	if err != nil {
+		return err
+	}
+	opts.demoPort = sim.Addr().Port
+	log.Printf("Demo mode: simulated Asterisk on %s", sim.Addr())
+
+	if records == nil {
+		// Demo lists the endpoints before returning, so the directory
+		// finds them at startup
+		sim.Demo(context.Background(), time.Duration(float64(2*time.Second)/opts.DemoSpeed))
+		return nil
+	}
+	go func() {
+		for {
+			// Wait for sipblf to log in so it sees the whole capture
+			for sim.Clients() == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			sim.Replay(context.Background(), records, opts.DemoSpeed)
+			log.Printf("Demo mode: capture finished, replaying again in %s", demoPause)
+			time.Sleep(demoPause)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"time"
+
+	"sipblf/state"
+)
+
+// syncDescriptions re-reads the directory and updates the cache,
+// broadcasting every change to connected clients. Devices new to the
+// directory are added; devices removed from it are dropped from the cache
+// if they are unavailable, otherwise they just lose their description.
+// Metadata-only changes are counted as updates.
+func syncDescriptions() state.ListingChanges {
+	listings := make(map[string]state.Listing)
+	for ext, entry := range getDirectoryEntries() {
+		listings[ext] = state.Listing{Description: entry.Description, Metadata: entry.Metadata}
+	}
+	changes, changed, removed := extensionCache.ApplyListings(listings)
+
+	for _, endpoint := range changed {
+		slog.Debug("Description changed", "extension", endpoint.Extension, "description", endpoint.Description, "metadata", endpoint.Metadata)
+		globalBroadcaster.BroadcastDescription(endpoint)
+		mqttPublisher.Refresh(endpoint.Extension)
+		redisRelay.PublishExtension(endpoint.Extension)
+	}
+	for _, endpoint := range removed {
+		slog.Debug("Endpoint removed", "extension", endpoint.Extension)
+		globalBroadcaster.BroadcastRemoval(endpoint.Extension)
+		mqttPublisher.Remove(endpoint.Extension)
+		redisRelay.Remove(endpoint.Extension)
+	}
+	if changes.Total() > 0 {
+		log.Printf("Descriptions synced: %d added, %d removed, %d renamed, %d updated", changes.Added, changes.Removed, changes.Renamed, changes.Updated)
+	}
+	return changes
+}
+
+// runDescriptionSync re-syncs descriptions every db.sync_interval. The
+// interval is re-read each time so a reload can change or disable it.
+func runDescriptionSync() {
+	for {
+		interval := currentConfig().DB.SyncInterval
+		if interval <= 0 {
+			// Disabled; check again later in case a reload enables it
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		if currentConfig().DB.SyncInterval <= 0 {
+			continue
+		}
+		syncDescriptions()
+	}
+}
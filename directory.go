@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivahaev/amigo"
+	"gopkg.in/yaml.v3"
+)
+
+// DirectoryEntry is what a directory source knows about one extension
+type DirectoryEntry struct {
+	Extension   string
+	Description string
+	// Metadata holds any other fields, e.g. department, site, floor, email, photo
+	Metadata map[string]string
+}
+
+// newDirectoryEntry builds an entry from a flat set of fields. "extension"
+// and "description" are taken out; every other non-empty field becomes
+// metadata under its lower-cased name.
+func newDirectoryEntry(fields map[string]string) (DirectoryEntry, bool) {
+	var entry DirectoryEntry
+	for k, v := range fields {
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		switch k {
+		case "extension":
+			entry.Extension = v
+		case "description":
+			entry.Description = v
+		default:
+			if k != "" && v != "" {
+				if entry.Metadata == nil {
+					entry.Metadata = make(map[string]string)
+				}
+				entry.Metadata[k] = v
+			}
+		}
+	}
+	return entry, entry.Extension != ""
+}
+
+// DirectoryProvider is a source of extension descriptions
+type DirectoryProvider interface {
+	// Name identifies the source in logs
+	Name() string
+	// Entries returns every extension the source knows about, keyed by extension
+	Entries(ctx context.Context) (map[string]DirectoryEntry, error)
+}
+
+// Directory merges several providers. Earlier providers take precedence:
+// an extension's description comes from the first provider that has a
+// non-empty one. If a provider fails, its last good result is used so a
+// transient outage does not wipe its descriptions.
+type Directory struct {
+	mu        sync.Mutex
+	providers []DirectoryProvider
+	lastGood  map[string]map[string]DirectoryEntry
+	// generation counts Configure calls, so a lookup that overlaps one
+	// does not store results for providers that have been replaced
+	generation int
+}
+
+// directory is the configured extension directory
+var directory = &Directory{}
+
+// Configure replaces the providers from configuration
+func (d *Directory) Configure(sources []DirectorySourceConfig, ami *amigo.Amigo) error {
+	apply, err := d.Prepare(sources, ami)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare creates the providers for a configuration and returns a function
+// that switches to them
+func (d *Directory) Prepare(sources []DirectorySourceConfig, ami *amigo.Amigo) (func(), error) {
+	var providers []DirectoryProvider
+	for _, src := range sources {
+		p, err := newDirectoryProvider(src, ami)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.providers = providers
+		d.lastGood = make(map[string]map[string]DirectoryEntry)
+		d.generation++
+	}, nil
+}
+
+// Lookup queries every provider and returns the merged entries. The lock
+// is not held while providers are queried, as they may go over the network.
+func (d *Directory) Lookup(ctx context.Context) map[string]DirectoryEntry {
+	d.mu.Lock()
+	providers, generation := d.providers, d.generation
+	d.mu.Unlock()
+
+	merged := make(map[string]DirectoryEntry)
+	// Apply lowest precedence first so higher precedence sources overwrite
+	for i := len(providers) - 1; i >= 0; i-- {
+		p := providers[i]
+		key := fmt.Sprintf("%d:%s", i, p.Name())
+		entries, err := p.Entries(ctx)
+		d.mu.Lock()
+		if err != nil {
+			log.Printf("Warning: Directory source %s failed, using last good result: %v", p.Name(), err)
+			entries = d.lastGood[key]
+		} else if d.generation == generation {
+			d.lastGood[key] = entries
+		}
+		d.mu.Unlock()
+		for ext, entry := range entries {
+			if existing, ok := merged[ext]; ok {
+				if entry.Description == "" {
+					entry.Description = existing.Description
+				}
+				if len(existing.Metadata) > 0 {
+					metadata := maps.Clone(existing.Metadata)
+					maps.Copy(metadata, entry.Metadata)
+					entry.Metadata = metadata
+				}
+			}
+			merged[ext] = entry
+		}
+	}
+	return merged
+}
+
+// newDirectoryProvider creates a provider from its configuration
+func newDirectoryProvider(c DirectorySourceConfig, ami *amigo.Amigo) (DirectoryProvider, error) {
+	switch c.Type {
+	case "freepbx":
+		return &FreePBXDirectory{}, nil
+	case "file":
+		return &FileDirectory{Path: c.Path}, nil
+	case "ami":
+		if ami == nil {
+			return nil, errors.New("ami directory source requires an AMI connection")
+		}
+		return &AMIDirectory{AMI: ami}, nil
+	case "http":
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		return &HTTPDirectory{URL: c.URL, Headers: c.Headers, Client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown directory source type %q", c.Type)
+	}
+}
+
+// FileDirectory reads descriptions from a CSV or YAML file, re-reading it on every lookup.
+//
+// CSV files have one "extension,description" row per extension. With a
+// header row, any further columns become metadata named by their header.
+// YAML files are either a map of extension to description or a list of
+// entries with extension, description and any metadata fields.
+type FileDirectory struct {
+	Path string
+}
+
+// Name identifies the source in logs
+func (f *FileDirectory) Name() string {
+	return "file:" + f.Path
+}
+
+// Entries reads the file
+func (f *FileDirectory) Entries(ctx context.Context) (map[string]DirectoryEntry, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".csv":
+		return parseDirectoryCSV(data)
+	case ".yaml", ".yml":
+		return parseDirectoryYAML(data)
+	default:
+		return nil, fmt.Errorf("unsupported directory file type %q (want .csv, .yaml or .yml)", filepath.Ext(f.Path))
+	}
+}
+
+func parseDirectoryCSV(data []byte) (map[string]DirectoryEntry, error) {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %v", err)
+	}
+
+	header := []string{"extension", "description"}
+	entries := make(map[string]DirectoryEntry)
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "extension") {
+			header = record
+			continue
+		}
+		fields := make(map[string]string)
+		for j, value := range record {
+			if j < len(header) {
+				fields[header[j]] = value
+			}
+		}
+		if entry, ok := newDirectoryEntry(fields); ok {
+			entries[entry.Extension] = entry
+		}
+	}
+	return entries, nil
+}
+
+func parseDirectoryYAML(data []byte) (map[string]DirectoryEntry, error) {
+	entries := make(map[string]DirectoryEntry)
+
+	var asMap map[string]string
+	if err := yaml.Unmarshal(data, &asMap); err == nil {
+		for ext, desc := range asMap {
+			entries[ext] = DirectoryEntry{Extension: ext, Description: desc}
+		}
+		return entries, nil
+	}
+
+	var asList []map[string]string
+	if err := yaml.Unmarshal(data, &asList); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: expected a map of extension to description or a list of entries: %v", err)
+	}
+	for _, fields := range asList {
+		if entry, ok := newDirectoryEntry(fields); ok {
+			entries[entry.Extension] = entry
+		}
+	}
+	return entries, nil
+}
+
+// HTTPDirectory fetches descriptions from a URL returning JSON, either an
+// object mapping extension to description or an array of objects with
+// "extension", "description" and any metadata fields.
+type HTTPDirectory struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// Name identifies the source in logs
+func (h *HTTPDirectory) Name() string {
+	return "http:" + h.URL
+}
+
+// Entries fetches and decodes the URL
+func (h *HTTPDirectory) Entries(ctx context.Context) (map[string]DirectoryEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]DirectoryEntry)
+
+	var asMap map[string]string
+	if err := json.Unmarshal(body, &asMap); err == nil {
+		for ext, desc := range asMap {
+			entries[ext] = DirectoryEntry{Extension: ext, Description: desc}
+		}
+		return entries, nil
+	}
+
+	var asList []map[string]interface{}
+	if err := json.Unmarshal(body, &asList); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	for _, item := range asList {
+		fields := make(map[string]string)
+		for k, v := range item {
+			switch v := v.(type) {
+			case string:
+				fields[k] = v
+			case float64, bool:
+				fields[k] = fmt.Sprint(v)
+			}
+		}
+		if entry, ok := newDirectoryEntry(fields); ok {
+			entries[entry.Extension] = entry
+		}
+	}
+	return entries, nil
+}
+
+// directoryLookupTimeout bounds a full directory lookup across all sources
+const directoryLookupTimeout = 30 * time.Second
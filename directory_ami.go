@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ivahaev/amigo"
+)
+
+// amiListPrefix marks the ActionIDs of list actions sent by sipblf itself
+const amiListPrefix = "sipblf-list-"
+
+// maxListEvents bounds the events kept for one list action, in case its
+// completion event never arrives
+const maxListEvents = 100000
+
+// AMIListCollector gathers the events that make up a list action's
+// response (e.g. EndpointList ... EndpointListComplete), routed by ActionID.
+type AMIListCollector struct {
+	mu      sync.Mutex
+	waiting map[string]*amiList
+	next    atomic.Uint64
+}
+
+// amiList is one list action in progress
+type amiList struct {
+	completeEvent string
+	events        []map[string]string
+	dropped       int
+	// done is closed when completeEvent arrives
+	done chan struct{}
+}
+
+// amiLists routes list action events to the goroutines waiting for them
+var amiLists = &AMIListCollector{waiting: make(map[string]*amiList)}
+
+// Handle receives AMI events; register it for every event type a list
+// action produces. It never blocks the AMI event loop: events are kept
+// under the collector's lock until the waiting goroutine takes them.
+func (c *AMIListCollector) Handle(m map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.waiting[m["ActionID"]]
+	if l == nil {
+		return
+	}
+	select {
+	case <-l.done:
+		return
+	default:
+	}
+	if strings.EqualFold(m["Event"], l.completeEvent) {
+		close(l.done)
+		return
+	}
+	if len(l.events) >= maxListEvents {
+		l.dropped++
+		return
+	}
+	l.events = append(l.events, m)
+}
+
+// Run sends action and returns the events carrying its ActionID until
+// completeEvent arrives or ctx ends
+func (c *AMIListCollector) Run(ctx context.Context, ami *amigo.Amigo, action map[string]string, completeEvent string) ([]map[string]string, error) {
+	id := fmt.Sprintf("%s%d", amiListPrefix, c.next.Add(1))
+	l := &amiList{completeEvent: completeEvent, done: make(chan struct{})}
+	c.mu.Lock()
+	c.waiting[id] = l
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+	}()
+
+	action["ActionID"] = id
+	resp, err := ami.Action(action)
+	if err != nil {
+		return nil, err
+	}
+	if resp["Response"] == "Error" {
+		return nil, fmt.Errorf("%s failed: %s", action["Action"], resp["Message"])
+	}
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %v", action["Action"], ctx.Err())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l.dropped > 0 {
+		log.Printf("Warning: %s returned more than %d events, %d dropped", action["Action"], maxListEvents, l.dropped)
+	}
+	return l.events, nil
+}
+
+// amiListEvents are the event types produced by the list actions sipblf sends
+var amiListEvents = []string{"EndpointList", "EndpointListComplete", "EndpointDetail", "EndpointDetailComplete"}
+
+// AMIDirectory takes descriptions from the caller ID name of each PJSIP
+// endpoint, for Asterisk systems without FreePBX
+type AMIDirectory struct {
+	AMI *amigo.Amigo
+}
+
+// Name identifies the source in logs
+func (a *AMIDirectory) Name() string {
+	return "ami"
+}
+
+var callerIDName = regexp.MustCompile(`^\s*"?([^"<]*?)"?\s*(<[^>]*>)?\s*$`)
+
+// Entries lists the PJSIP endpoints and reads each one's caller ID
+func (a *AMIDirectory) Entries(ctx context.Context) (map[string]DirectoryEntry, error) {
+	if !a.AMI.Connected() {
+		return nil, errors.New("not connected to AMI")
+	}
+
+	list, err := amiLists.Run(ctx, a.AMI, map[string]string{"Action": "PJSIPShowEndpoints"}, "EndpointListComplete")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]DirectoryEntry)
+	for _, item := range list {
+		name := item["ObjectName"]
+		if item["Event"] != "EndpointList" || name == "" {
+			continue
+		}
+		details, err := amiLists.Run(ctx, a.AMI, map[string]string{"Action": "PJSIPShowEndpoint", "Endpoint": name}, "EndpointDetailComplete")
+		if err != nil {
+			return nil, err
+		}
+		entry := DirectoryEntry{Extension: name}
+		for _, d := range details {
+			if d["Event"] == "EndpointDetail" {
+				if m := callerIDName.FindStringSubmatch(d["Callerid"]); m != nil {
+					entry.Description = strings.TrimSpace(m[1])
+				}
+			}
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
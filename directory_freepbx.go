@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// retiredPoolDelay is how long a replaced pool stays open for lookups that
+// took it before the database settings changed, which cannot run longer
+// than directoryLookupTimeout
+const retiredPoolDelay = 2 * directoryLookupTimeout
+
+// DevicePool is a long-lived connection pool to the FreePBX database. It
+// opens a new pool if the database settings change on reload.
+type DevicePool struct {
+	mu  sync.Mutex
+	db  *sql.DB
+	dsn string
+}
+
+var devicePool = &DevicePool{}
+
+// Get returns a pool for c, or nil if no database is configured
+func (p *DevicePool) Get(c DBConfig) (*sql.DB, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c.Host == "" {
+		p.retireLocked()
+		return nil, nil
+	}
+	dsn := c.DSN()
+	if p.db != nil && p.dsn == dsn {
+		return p.db, nil
+	}
+
+	p.retireLocked()
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(30 * time.Minute)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	p.db, p.dsn = db, dsn
+	return db, nil
+}
+
+// retireLocked stops handing out the current pool. Callers may still be
+// using it, so it only stops keeping idle connections now and is closed
+// once their lookups have had time to finish.
+func (p *DevicePool) retireLocked() {
+	if p.db == nil {
+		return
+	}
+	old := p.db
+	old.SetMaxIdleConns(0)
+	time.AfterFunc(retiredPoolDelay, func() { old.Close() })
+	p.db, p.dsn = nil, ""
+}
+
+// FreePBXDirectory reads descriptions from the FreePBX devices table over
+// the shared pool. It returns nothing if no database is configured.
+type FreePBXDirectory struct{}
+
+// Name identifies the source in logs
+func (f *FreePBXDirectory) Name() string {
+	return "freepbx"
+}
+
+// Entries queries the devices table
+func (f *FreePBXDirectory) Entries(ctx context.Context) (map[string]DirectoryEntry, error) {
+	entries := make(map[string]DirectoryEntry)
+
+	db, err := devicePool.Get(currentConfig().DB)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return entries, nil
+	}
+
+	// Query device descriptions
+	rows, err := db.QueryContext(ctx, "SELECT id, description FROM devices")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+	defer rows.Close()
+
+	// Process results
+	for rows.Next() {
+		var id, description string
+		if err := rows.Scan(&id, &description); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		entries[id] = DirectoryEntry{Extension: id, Description: description}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read devices: %v", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ivahaev/amigo"
+
+	"sipblf/amisim"
+)
+
+func TestParseDirectoryCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]DirectoryEntry
+		wantErr bool
+	}{
+		{
+			name: "without header",
+			data: "100,Reception\n101, Sales \n",
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception"},
+				"101": {Extension: "101", Description: "Sales"},
+			},
+		},
+		{
+			name: "header with metadata",
+			data: "Extension,Description,Department,Floor\n100,Reception,Front,1\n101,Sales,,2\n",
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception", Metadata: map[string]string{"department": "Front", "floor": "1"}},
+				"101": {Extension: "101", Description: "Sales", Metadata: map[string]string{"floor": "2"}},
+			},
+		},
+		{
+			name: "comments, short rows and rows without an extension",
+			data: "# exported from the PBX\n100\n,Nobody\n101,Sales,extra\n",
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100"},
+				"101": {Extension: "101", Description: "Sales"},
+			},
+		},
+		{
+			name:    "unterminated quote",
+			data:    "100,\"Reception\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDirectoryCSV([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDirectoryYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]DirectoryEntry
+		wantErr bool
+	}{
+		{
+			name: "map of descriptions",
+			data: "\"100\": Reception\n101: Sales\n",
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception"},
+				"101": {Extension: "101", Description: "Sales"},
+			},
+		},
+		{
+			name: "list of entries",
+			data: "- extension: 100\n  description: Reception\n  site: Wellington\n- description: No extension\n",
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception", Metadata: map[string]string{"site": "Wellington"}},
+			},
+		},
+		{
+			name:    "neither",
+			data:    "just a string\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDirectoryYAML([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    map[string]DirectoryEntry
+		wantErr bool
+	}{
+		{
+			name:   "object of descriptions",
+			status: http.StatusOK,
+			body:   `{"100": "Reception", "101": "Sales"}`,
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception"},
+				"101": {Extension: "101", Description: "Sales"},
+			},
+		},
+		{
+			name:   "array of entries",
+			status: http.StatusOK,
+			body:   `[{"extension": "100", "description": "Reception", "floor": 2, "remote": false, "manager": null}]`,
+			want: map[string]DirectoryEntry{
+				"100": {Extension: "100", Description: "Reception", Metadata: map[string]string{"floor": "2", "remote": "false"}},
+			},
+		},
+		{
+			name:    "error status",
+			status:  http.StatusServiceUnavailable,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			status:  http.StatusOK,
+			body:    `<html></html>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer secret" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			h := &HTTPDirectory{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer secret"}, Client: srv.Client()}
+			got, err := h.Entries(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMIDirectory(t *testing.T) {
+	sim, err := amisim.Listen("127.0.0.1:0", "sipblf", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	sim.AddEndpoint("100", "Reception")
+	sim.AddEndpoint("101", "")
+
+	ami := amigo.New(&amigo.Settings{
+		Host:              "127.0.0.1",
+		Port:              strconv.Itoa(sim.Addr().Port),
+		Username:          "sipblf",
+		Password:          "secret",
+		DialTimeout:       time.Second,
+		ReconnectInterval: time.Second,
+	})
+	for _, event := range amiListEvents {
+		ami.RegisterHandler(event, amiLists.Handle)
+	}
+	connected := make(chan struct{}, 1)
+	ami.On("connect", func(string) {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	ami.Connect()
+	defer ami.Close()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out connecting to the simulated Asterisk")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := (&AMIDirectory{AMI: ami}).Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]DirectoryEntry{
+		"100": {Extension: "100", Description: "Reception"},
+		"101": {Extension: "101"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCallerIDName(t *testing.T) {
+	tests := []struct {
+		callerID string
+		want     string
+	}{
+		{`"Reception" <100>`, "Reception"},
+		{`Reception <100>`, "Reception"},
+		{`"Front Desk"`, "Front Desk"},
+		{`<100>`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		m := callerIDName.FindStringSubmatch(tt.callerID)
+		if m == nil {
+			t.Errorf("%q did not match", tt.callerID)
+		} else if got := m[1]; got != tt.want {
+			t.Errorf("%q: name %q, want %q", tt.callerID, got, tt.want)
+		}
+	}
+}
+
+// fakeDirectory is a provider returning fixed entries, or failing
+type fakeDirectory struct {
+	name    string
+	entries map[string]DirectoryEntry
+	err     error
+}
+
+func (f *fakeDirectory) Name() string { return f.name }
+
+func (f *fakeDirectory) Entries(ctx context.Context) (map[string]DirectoryEntry, error) {
+	return f.entries, f.err
+}
+
+func TestDirectoryLookup(t *testing.T) {
+	first := &fakeDirectory{name: "first", entries: map[string]DirectoryEntry{
+		"100": {Extension: "100", Description: "Reception", Metadata: map[string]string{"site": "HQ"}},
+		"101": {Extension: "101", Metadata: map[string]string{"floor": "3"}},
+	}}
+	second := &fakeDirectory{name: "second", entries: map[string]DirectoryEntry{
+		"100": {Extension: "100", Description: "Front desk", Metadata: map[string]string{"site": "Branch", "email": "front@example.com"}},
+		"101": {Extension: "101", Description: "Sales", Metadata: map[string]string{"floor": "2"}},
+		"102": {Extension: "102", Description: "Support"},
+	}}
+	d := &Directory{
+		providers: []DirectoryProvider{first, second},
+		lastGood:  make(map[string]map[string]DirectoryEntry),
+	}
+
+	want := map[string]DirectoryEntry{
+		// The first source wins, keeping metadata only the second has
+		"100": {Extension: "100", Description: "Reception", Metadata: map[string]string{"site": "HQ", "email": "front@example.com"}},
+		// An empty description falls through to the next source
+		"101": {Extension: "101", Description: "Sales", Metadata: map[string]string{"floor": "3"}},
+		"102": {Extension: "102", Description: "Support"},
+	}
+	if got := d.Lookup(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A failing source is replaced by its last good result
+	second.entries, second.err = nil, errors.New("unavailable")
+	if got := d.Lookup(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a failure got %+v, want %+v", got, want)
+	}
+}
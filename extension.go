@@ -0,0 +1,145 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// defaultExtensionPattern keeps only numeric extensions, as sipblf always has
+const defaultExtensionPattern = `^[0-9]+$`
+
+// defaultPublicPattern shows anonymous visitors numeric extensions of five
+// or more digits, as sipblf always has
+const defaultPublicPattern = `^[0-9]{5,}$`
+
+// extensionPattern decides which device names are shown as extensions
+var extensionPattern atomic.Pointer[regexp.Regexp]
+
+// setExtensionPattern replaces the extension allow-list. The pattern has
+// already been checked by Config.Validate.
+func setExtensionPattern(pattern string) {
+	extensionPattern.Store(regexp.MustCompile(pattern))
+}
+
+// publicPattern decides which extensions anonymous visitors may see
+var publicPattern atomic.Pointer[regexp.Regexp]
+
+// setPublicPattern replaces the public allow-list. The pattern has already
+// been checked by Config.Validate.
+func setPublicPattern(pattern string) {
+	publicPattern.Store(regexp.MustCompile(pattern))
+}
+
+// isPublic reports whether an extension is visible without logging in
+func isPublic(ext string) bool {
+	re := publicPattern.Load()
+	if re == nil {
+		re = regexp.MustCompile(defaultPublicPattern)
+		publicPattern.CompareAndSwap(nil, re)
+	}
+	return ext != "" && re.MatchString(ext)
+}
+
+// isExtension reports whether a device name is allowed as an extension
+func isExtension(ext string) bool {
+	re := extensionPattern.Load()
+	if re == nil {
+		re = regexp.MustCompile(defaultExtensionPattern)
+		extensionPattern.CompareAndSwap(nil, re)
+	}
+	return ext != "" && re.MatchString(ext)
+}
+
+// naturalLess orders extensions so that runs of digits compare by value,
+// e.g. 2 < 10 < 100 < reception and door2 < door10. It follows the
+// Intl.Collator({numeric: true}) the page sorts with, so rows added live
+// land where the server put them: case is ignored, and spaces and
+// punctuation come before digits, which come before letters.
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if unicode.IsDigit(ra[i]) && unicode.IsDigit(rb[j]) {
+			// Compare whole digit runs by value: ignore leading zeros, then
+			// a longer run is larger, otherwise compare digit by digit
+			si, sj := i, j
+			for i < len(ra) && unicode.IsDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && unicode.IsDigit(rb[j]) {
+				j++
+			}
+			na, nb := trimZeros(ra[si:i]), trimZeros(rb[sj:j])
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			for k := range na {
+				if na[k] != nb[k] {
+					return na[k] < nb[k]
+				}
+			}
+			continue
+		}
+		ca, cb := unicode.ToLower(ra[i]), unicode.ToLower(rb[j])
+		if ca != cb {
+			return collationKey(ca) < collationKey(cb)
+		}
+		i++
+		j++
+	}
+	if len(ra)-i != len(rb)-j {
+		return len(ra)-i < len(rb)-j
+	}
+	// Equal to the collator, e.g. 7 and 007: any fixed order will do
+	return a < b
+}
+
+// collatorPunctuation is the order the collator gives ASCII spaces,
+// punctuation and symbols, all of which come before digits and letters
+const collatorPunctuation = " _-,;:!?.'\"()[]{}@*/\\&#%`^+<=>|~$"
+
+// collationKey ranks a lower-cased character that is not part of a number
+// as the collator does: spaces, punctuation and symbols, then digits, then
+// letters, each otherwise in code point order
+func collationKey(r rune) int64 {
+	if k := strings.IndexRune(collatorPunctuation, r); k >= 0 {
+		return int64(k)
+	}
+	switch {
+	case unicode.IsLetter(r):
+		return 3<<32 | int64(r)
+	case unicode.IsDigit(r):
+		return 2<<32 | int64(r)
+	default:
+		return 1<<32 | int64(r)
+	}
+}
+
+func trimZeros(digits []rune) []rune {
+	for len(digits) > 1 && digits[0] == '0' {
+		digits = digits[1:]
+	}
+	return digits
+}
+
+// deviceExtension maps an Asterisk device name to its extension, using the
+// explicit device map first and then the technology prefixes. Local
+// channels drop their dialplan context, so Local/101@from-internal is 101.
+func deviceExtension(device string) (string, bool) {
+	cfg := currentConfig().Extensions
+	ext, ok := cfg.Devices[device]
+	if !ok {
+		for _, tech := range cfg.Technologies {
+			if rest, found := strings.CutPrefix(device, tech); found {
+				if tech == "Local/" {
+					rest, _, _ = strings.Cut(rest, "@")
+				}
+				ext, ok = rest, true
+				break
+			}
+		}
+	}
+	return ext, ok && isExtension(ext)
+}
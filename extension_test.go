@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"2", "10"},
+		{"10", "100"},
+		{"9", "10a"},
+		{"100", "reception"},
+		{"door", "door2"},
+		{"door2", "door10"},
+		{"door10", "Door11"},
+		{"Door", "door"},
+		{"007", "7"},
+		{"07a", "7b"},
+		{"z9", "z10"},
+		{"zz", "zz1"},
+		// Spaces and punctuation before digits, digits before letters
+		{"b 2", "b-2"},
+		{"b-2", "b2"},
+		{"1.5", "1a"},
+		{"~", "0"},
+		{"9", "a"},
+		// Punctuation in the collator's order, not ASCII order
+		{"_x", "-1"},
+		{"~", "$"},
+	}
+	for _, tt := range tests {
+		if !naturalLess(tt.a, tt.b) {
+			t.Errorf("naturalLess(%q, %q) = false, want true", tt.a, tt.b)
+		}
+		if naturalLess(tt.b, tt.a) {
+			t.Errorf("naturalLess(%q, %q) = true, want false", tt.b, tt.a)
+		}
+	}
+}
+
+func TestNaturalSort(t *testing.T) {
+	// In the order Intl.Collator(undefined, {numeric: true, sensitivity:
+	// 'base'}) gives, ties broken by code point
+	want := []string{
+		"_x", "-1", "~", "0", "00", "1", "1 5", "1-2", "1.5", "1a", "2", "007",
+		"7", "07a", "7b", "9", "10", "100", "101", "101a", "a", "b 2", "b-2",
+		"b2", "Door", "door", "door2", "door10", "Ops", "ops1", "Reception",
+		"reception", "Sales", "sales 2", "z9", "z10", "zz",
+	}
+	got := slices.Clone(want)
+	slices.Reverse(got)
+	slices.SortFunc(got, func(a, b string) int {
+		switch {
+		case naturalLess(a, b):
+			return -1
+		case naturalLess(b, a):
+			return 1
+		}
+		return 0
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("sorted\n%q\nwant\n%q", got, want)
+	}
+}
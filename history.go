@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"sipblf/state"
+)
+
+// HistoryStore records state transitions in a BoltDB file. Each extension
+// has its own bucket keyed by an 8-byte big-endian time (Unix nanoseconds)
+// followed by an 8-byte sequence number, so keys sort by time.
+type HistoryStore struct {
+	db      *bolt.DB
+	pending chan state.Transition
+}
+
+// history is the transition store, nil when history is disabled
+var history *HistoryStore
+
+var historyBucket = []byte("history")
+
+// OpenHistoryStore opens (creating if needed) the history file and starts
+// the background writer and retention cleanup
+func OpenHistoryStore(c HistoryConfig) (*HistoryStore, error) {
+	db, err := bolt.Open(c.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file %s: %v", c.Path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise history file %s: %v", c.Path, err)
+	}
+
+	h := &HistoryStore{
+		db:      db,
+		pending: make(chan state.Transition, 1000),
+	}
+	go h.writer()
+	go h.startCleanup(c.CleanupInterval)
+	return h, nil
+}
+
+// Record queues a transition to be written. It never blocks: if the
+// writer has fallen far behind, the transition is dropped with a warning.
+func (h *HistoryStore) Record(t state.Transition) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.pending <- t:
+	default:
+		log.Printf("Warning: History write queue full, transition for %s dropped", t.Extension)
+	}
+}
+
+// writer saves queued transitions, batching bursts into one transaction
+func (h *HistoryStore) writer() {
+	for t := range h.pending {
+		batch := []state.Transition{t}
+	drain:
+		for len(batch) < 500 {
+			select {
+			case t := <-h.pending:
+				batch = append(batch, t)
+			default:
+				break drain
+			}
+		}
+		if err := h.write(batch); err != nil {
+			log.Printf("Warning: Failed to write %d history transitions: %v", len(batch), err)
+		}
+	}
+}
+
+func (h *HistoryStore) write(batch []state.Transition) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(historyBucket)
+		for _, t := range batch {
+			bucket, err := root.CreateBucketIfNotExists([]byte(t.Extension))
+			if err != nil {
+				return err
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(historyKey(t.Time, seq), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func historyKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// Timeline returns an extension's transitions between from and to, oldest
+// first, along with the last transition before from (nil if none), which
+// gives the state the extension was in at the start of the range
+func (h *HistoryStore) Timeline(ext string, from, to time.Time) (*state.Transition, []state.Transition, error) {
+	var before *state.Transition
+	transitions := []state.Transition{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(ext))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		start := historyKey(from, 0)
+		end := historyKey(to, ^uint64(0))
+
+		k, v := c.Seek(start)
+		// The entry just before the range, if any
+		var pk, pv []byte
+		if k == nil {
+			pk, pv = c.Last()
+		} else {
+			pk, pv = c.Prev()
+			c.Seek(start)
+		}
+		if pk != nil {
+			var t state.Transition
+			if err := json.Unmarshal(pv, &t); err != nil {
+				return err
+			}
+			before = &t
+		}
+
+		for ; k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			var t state.Transition
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			transitions = append(transitions, t)
+		}
+		return nil
+	})
+	return before, transitions, err
+}
+
+// Last returns an extension's most recent transition, nil if it has none
+func (h *HistoryStore) Last(ext string) (*state.Transition, error) {
+	var last *state.Transition
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(ext))
+		if bucket == nil {
+			return nil
+		}
+		if _, v := bucket.Cursor().Last(); v != nil {
+			last = &state.Transition{}
+			return json.Unmarshal(v, last)
+		}
+		return nil
+	})
+	return last, err
+}
+
+// Extensions returns every extension with recorded history
+func (h *HistoryStore) Extensions() ([]string, error) {
+	var exts []string
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEachBucket(func(k []byte) error {
+			exts = append(exts, string(k))
+			return nil
+		})
+	})
+	return exts, err
+}
+
+func (h *HistoryStore) startCleanup(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		// Retention may change on reload
+		retention := currentConfig().History.Retention
+		if retention <= 0 {
+			continue
+		}
+		removed, err := h.deleteBefore(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Warning: Failed to remove old history: %v", err)
+		} else if removed > 0 {
+			slog.Debug("Removed old history", "transitions", removed)
+		}
+	}
+}
+
+// deleteBefore removes every transition older than cutoff. The most recent
+// transition of each extension is kept so its current state stays known.
+func (h *HistoryStore) deleteBefore(cutoff time.Time) (int, error) {
+	removed := 0
+	limit := historyKey(cutoff, 0)
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(historyBucket)
+		return root.ForEachBucket(func(ext []byte) error {
+			bucket := root.Bucket(ext)
+			lastKey, _ := bucket.Cursor().Last()
+			// Collect keys first; deleting while iterating a cursor can skip entries
+			var old [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0 && !bytes.Equal(k, lastKey); k, _ = c.Next() {
+				old = append(old, append([]byte(nil), k...))
+			}
+			for _, k := range old {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += len(old)
+			return nil
+		})
+	})
+	return removed, err
+}
+
+// parseTimeRange reads the from and to query parameters (RFC 3339). To
+// defaults to now and from to defaultSpan before to.
+func parseTimeRange(r *http.Request, defaultSpan time.Duration) (time.Time, time.Time, error) {
+	to := time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %v", err)
+		}
+		to = t
+	}
+	from := to.Add(-defaultSpan)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %v", err)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// registerHistoryRoutes adds the timeline API
+func registerHistoryRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/extensions/{ext}/history", func(w http.ResponseWriter, r *http.Request) {
+		scope, err := requestScope(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ext := r.PathValue("ext")
+		if !isExtension(ext) || !scope.CanSee(ext) {
+			http.NotFound(w, r)
+			return
+		}
+		if ingestOnly(w, "History") {
+			return
+		}
+		if history == nil {
+			http.Error(w, "History is disabled", http.StatusNotFound)
+			return
+		}
+		from, to, err := parseTimeRange(r, 24*time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		before, transitions, err := history.Timeline(ext, from, to)
+		if err != nil {
+			slog.Error("Failed to read history", "extension", ext, "error", err)
+			http.Error(w, "Failed to read history", http.StatusInternalServerError)
+			return
+		}
+		var initial *state.State
+		if before != nil {
+			initial = &before.To
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"extension":   ext,
+			"from":        from.UTC(),
+			"to":          to.UTC(),
+			"initial":     initial,
+			"transitions": transitions,
+		})
+	})
+}
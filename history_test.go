@@ -0,0 +1,281 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"sipblf/state"
+)
+
+// testHistory opens a history file in a temporary directory without
+// starting the writer, so tests can inspect what is queued
+func testHistory(t *testing.T, queue int) *HistoryStore {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return &HistoryStore{db: db, pending: make(chan state.Transition, queue)}
+}
+
+// queued takes every transition waiting to be written
+func queued(h *HistoryStore) []state.Transition {
+	var ts []state.Transition
+	for {
+		select {
+		case t := <-h.pending:
+			ts = append(ts, t)
+		default:
+			return ts
+		}
+	}
+}
+
+var historyStart = time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return historyStart.Add(time.Duration(minutes) * time.Minute)
+}
+
+func TestHistoryTimeline(t *testing.T) {
+	h := testHistory(t, 1)
+	if err := h.write([]state.Transition{
+		{Time: at(0), Extension: "100", From: state.Unavailable, To: state.NotInUse},
+		{Time: at(10), Extension: "100", From: state.NotInUse, To: state.Ringing},
+		{Time: at(11), Extension: "100", From: state.Ringing, To: state.InUse},
+		{Time: at(11), Extension: "100", From: state.InUse, To: state.OnHold},
+		{Time: at(20), Extension: "100", From: state.OnHold, To: state.NotInUse},
+		{Time: at(5), Extension: "101", From: state.NotInUse, To: state.InUse},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ext        string
+		from, to   time.Time
+		wantBefore state.State // Unknown for none
+		wantTo     []state.State
+	}{
+		{"whole range", "100", at(-10), at(30), state.Unknown, []state.State{state.NotInUse, state.Ringing, state.InUse, state.OnHold, state.NotInUse}},
+		{"starting mid-way", "100", at(5), at(15), state.NotInUse, []state.State{state.Ringing, state.InUse, state.OnHold}},
+		{"bounds are inclusive", "100", at(10), at(11), state.NotInUse, []state.State{state.Ringing, state.InUse, state.OnHold}},
+		{"after the last change", "100", at(25), at(30), state.NotInUse, []state.State{}},
+		{"before the first change", "100", at(-10), at(-5), state.Unknown, []state.State{}},
+		{"other extension", "101", at(0), at(30), state.Unknown, []state.State{state.InUse}},
+		{"no history", "102", at(0), at(30), state.Unknown, []state.State{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, transitions, err := h.Timeline(tt.ext, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotBefore := state.Unknown
+			if before != nil {
+				gotBefore = before.To
+			}
+			if gotBefore != tt.wantBefore {
+				t.Errorf("state at from = %v, want %v", gotBefore, tt.wantBefore)
+			}
+			gotTo := []state.State{}
+			for _, tr := range transitions {
+				gotTo = append(gotTo, tr.To)
+			}
+			if !reflect.DeepEqual(gotTo, tt.wantTo) {
+				t.Errorf("transitions to %v, want %v", gotTo, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestHistoryDeleteBefore(t *testing.T) {
+	h := testHistory(t, 1)
+	if err := h.write([]state.Transition{
+		{Time: at(0), Extension: "100", From: state.Unavailable, To: state.NotInUse},
+		{Time: at(10), Extension: "100", From: state.NotInUse, To: state.InUse},
+		{Time: at(20), Extension: "100", From: state.InUse, To: state.NotInUse},
+		// Long unchanged: the only transition is old but must be kept
+		{Time: at(0), Extension: "101", From: state.NotInUse, To: state.Unavailable},
+		{Time: at(1), Extension: "101", From: state.Unavailable, To: state.NotInUse},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := h.deleteBefore(at(15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("removed %d transitions, want 3", removed)
+	}
+
+	tests := []struct {
+		ext  string
+		want []time.Time
+	}{
+		{"100", []time.Time{at(20)}},
+		{"101", []time.Time{at(1)}},
+	}
+	for _, tt := range tests {
+		_, transitions, err := h.Timeline(tt.ext, at(-60), at(60))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []time.Time
+		for _, tr := range transitions {
+			got = append(got, tr.Time)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.ext, got, tt.want)
+		}
+	}
+
+	// Nothing more to remove
+	if removed, _ := h.deleteBefore(at(15)); removed != 0 {
+		t.Errorf("second pass removed %d transitions", removed)
+	}
+}
+
+func TestHistoryRecordDropsWhenFull(t *testing.T) {
+	h := testHistory(t, 2)
+	done := make(chan struct{})
+	go func() {
+		for i := range 3 {
+			h.Record(state.Transition{Time: at(i), Extension: "100", To: state.InUse})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked on a full queue")
+	}
+	got := queued(h)
+	if len(got) != 2 || !got[0].Time.Equal(at(0)) || !got[1].Time.Equal(at(1)) {
+		t.Errorf("queued %+v, want the first two transitions", got)
+	}
+
+	// A nil store, with history disabled, ignores transitions
+	var disabled *HistoryStore
+	disabled.Record(state.Transition{Extension: "100"})
+}
+
+func TestHistoryWriter(t *testing.T) {
+	h, err := OpenHistoryStore(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.Close() })
+
+	h.Record(state.Transition{Time: at(0), Extension: "100", From: state.NotInUse, To: state.InUse})
+	h.Record(state.Transition{Time: at(1), Extension: "100", From: state.InUse, To: state.NotInUse})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		last, err := h.Last("100")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != nil && last.Time.Equal(at(1)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("last transition %+v, want the one at %v", last, at(1))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if exts, _ := h.Extensions(); !reflect.DeepEqual(exts, []string{"100"}) {
+		t.Errorf("extensions %v, want [100]", exts)
+	}
+}
+
+// TestInitialStates runs a restart: states are seeded from history, the
+// initial load reports every device, and only real changes are passed on
+func TestInitialStates(t *testing.T) {
+	h := testHistory(t, 100)
+	if err := h.write([]state.Transition{
+		{Time: at(0), Extension: "100", From: state.Unavailable, To: state.NotInUse},
+		{Time: at(0), Extension: "101", From: state.Unavailable, To: state.NotInUse},
+		{Time: at(0), Extension: "102", From: state.NotInUse, To: state.InUse},
+		{Time: at(0), Extension: "103", From: state.NotInUse, To: state.Unavailable},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	oldHistory, oldCache, oldDirectory := history, extensionCache, directory
+	t.Cleanup(func() { history, extensionCache, directory = oldHistory, oldCache, oldDirectory })
+	history, extensionCache = h, state.NewCache()
+	entries := make(map[string]DirectoryEntry)
+	for _, ext := range []string{"100", "101", "102", "103", "104"} {
+		entries[ext] = DirectoryEntry{Extension: ext}
+	}
+	directory = &Directory{
+		providers: []DirectoryProvider{&fakeDirectory{name: "test", entries: entries}},
+		lastGood:  make(map[string]map[string]DirectoryEntry),
+	}
+
+	seeded, recorded := initializeExtensionCache()
+	if got, _ := extensionCache.Snapshot("103"); got.Status != state.Unavailable || !got.Since.Equal(at(0)) {
+		t.Errorf("103 seeded as %v since %v, want unavailable since %v", got.Status, got.Since, at(0))
+	}
+
+	initialLoad.Store(true)
+	for _, r := range []struct {
+		ext, device string
+		state       state.State
+	}{
+		{"100", "PJSIP/100", state.NotInUse},
+		// Devices reported one at a time pass through other states
+		{"101", "PJSIP/101", state.InUse},
+		{"101", "PJSIP/101-app", state.NotInUse},
+		{"102", "PJSIP/102-app", state.NotInUse},
+		{"102", "PJSIP/102", state.InUse},
+		{"103", "PJSIP/103", state.NotInUse},
+		{"104", "PJSIP/104", state.NotInUse},
+	} {
+		previous, endpoint := extensionCache.UpdateDevice(r.ext, r.device, r.state)
+		deviceUpdated(r.device, previous, endpoint)
+	}
+	if got := queued(h); len(got) != 0 {
+		t.Fatalf("recorded %+v during the initial load", got)
+	}
+	settleInitialStates(seeded, recorded)
+	initialLoad.Store(false)
+
+	got := make(map[string]state.Transition)
+	for _, tr := range queued(h) {
+		if _, dup := got[tr.Extension]; dup {
+			t.Errorf("more than one transition for %s", tr.Extension)
+		}
+		got[tr.Extension] = tr
+	}
+	want := map[string][2]state.State{
+		"101": {state.NotInUse, state.InUse},
+		"103": {state.Unavailable, state.NotInUse},
+		// No history: recorded so the next restart has it
+		"104": {state.Unavailable, state.NotInUse},
+	}
+	if len(got) != len(want) {
+		t.Errorf("transitions for %d extensions, want %d: %+v", len(got), len(want), got)
+	}
+	for ext, w := range want {
+		if tr := got[ext]; tr.From != w[0] || tr.To != w[1] {
+			t.Errorf("%s: transition %v to %v, want %v to %v", ext, tr.From, tr.To, w[0], w[1])
+		}
+	}
+	for _, ext := range []string{"100", "102"} {
+		if e, _ := extensionCache.Snapshot(ext); !e.Since.Equal(at(0)) {
+			t.Errorf("%s: since %v, want %v from history", ext, e.Since, at(0))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Package ingest turns Asterisk Manager Interface (AMI) device state events
+// into extension states in a state.Cache.
+package ingest
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"sipblf/state"
+)
+
+// Mapper maps an Asterisk device, such as PJSIP/101, to its extension
+type Mapper interface {
+	Extension(device string) (string, bool)
+}
+
+// MapperFunc adapts a function to a Mapper
+type MapperFunc func(device string) (string, bool)
+
+// Extension calls f(device)
+func (f MapperFunc) Extension(device string) (string, bool) {
+	return f(device)
+}
+
+// Listener is told about every device state report that maps to an extension
+type Listener interface {
+	// DeviceUpdated receives the extension's combined state before the
+	// report and a snapshot of the extension after it
+	DeviceUpdated(device string, previous state.State, endpoint state.Endpoint)
+}
+
+// ListenerFunc adapts a function to a Listener
+type ListenerFunc func(device string, previous state.State, endpoint state.Endpoint)
+
+// DeviceUpdated calls f(device, previous, endpoint)
+func (f ListenerFunc) DeviceUpdated(device string, previous state.State, endpoint state.Endpoint) {
+	f(device, previous, endpoint)
+}
+
+// AMI is the part of an AMI client used to load the initial states;
+// *amigo.Amigo satisfies it
+type AMI interface {
+	Action(action map[string]string) (map[string]string, error)
+	SetEventChannel(c chan map[string]string)
+}
+
+// Ingester applies device state events to a cache
+type Ingester struct {
+	cache    *state.Cache
+	mapper   Mapper
+	listener Listener
+}
+
+// New creates an ingester that stores states in cache. Devices that mapper
+// does not map are ignored. listener may be nil.
+func New(cache *state.Cache, mapper Mapper, listener Listener) *Ingester {
+	return &Ingester{cache: cache, mapper: mapper, listener: listener}
+}
+
+// HandleEvent processes a DeviceStateChange or DeviceState event and
+// ignores anything else, so it can be registered as an AMI event handler
+func (in *Ingester) HandleEvent(m map[string]string) {
+	// Only process state-related events
+	if event := m["Event"]; event != "DeviceStateChange" && event != "DeviceState" {
+		return
+	}
+	// Only handle devices that map to an extension
+	device := m["Device"]
+	ext, ok := in.mapper.Extension(device)
+	if !ok {
+		return
+	}
+	readableState := state.Parse(m["State"])
+	log.Printf("State change: %s (%s) -> %s", ext, device, readableState) // Keep this as regular log for important state changes
+	previous, endpoint := in.cache.UpdateDevice(ext, device, readableState)
+	if in.listener != nil {
+		in.listener.DeviceUpdated(device, previous, endpoint)
+	}
+}
+
+// LoadStates asks Asterisk for the state of every device and processes the
+// replies, waiting up to timeout for the list to complete. Events are read
+// from an event channel set on ami for the duration.
+func (in *Ingester) LoadStates(ami AMI, timeout time.Duration) error {
+	// Create a channel to receive device state events
+	eventChan := make(chan map[string]string, 100)
+	ami.SetEventChannel(eventChan)
+	// Stop receiving events
+	defer ami.SetEventChannel(nil)
+
+	log.Printf("Requesting initial device states")
+	resp, err := ami.Action(map[string]string{"Action": "DeviceStateList", "ActionID": "init"})
+	if err != nil {
+		return fmt.Errorf("DeviceStateList failed: %v", err)
+	}
+	slog.Debug("DeviceStateList response", "response", resp)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-eventChan:
+			switch event["Event"] {
+			case "DeviceState", "DeviceStateChange":
+				in.HandleEvent(event)
+			case "DeviceStateListComplete":
+				// All device states received
+				log.Printf("Device state list complete")
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for DeviceStateListComplete")
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"sipblf/state"
+)
+
+// pjsipMapper maps PJSIP/<ext> and PJSIP/<ext>-<suffix> to <ext>
+var pjsipMapper = MapperFunc(func(device string) (string, bool) {
+	ext, ok := strings.CutPrefix(device, "PJSIP/")
+	if !ok || ext == "" {
+		return "", false
+	}
+	ext, _, _ = strings.Cut(ext, "-")
+	return ext, true
+})
+
+// update is one call to a Listener
+type update struct {
+	device   string
+	previous state.State
+	status   state.State
+}
+
+func TestHandleEvent(t *testing.T) {
+	tests := []struct {
+		name        string
+		events      []map[string]string
+		wantUpdates []update
+		// wantCache maps each cached extension to its status
+		wantCache map[string]state.State
+	}{
+		{
+			name:        "state change",
+			events:      []map[string]string{{"Event": "DeviceStateChange", "Device": "PJSIP/101", "State": "INUSE"}},
+			wantUpdates: []update{{"PJSIP/101", state.Unknown, state.InUse}},
+			wantCache:   map[string]state.State{"101": state.InUse},
+		},
+		{
+			name:        "device state list entry",
+			events:      []map[string]string{{"Event": "DeviceState", "Device": "PJSIP/101", "State": "NOT_INUSE"}},
+			wantUpdates: []update{{"PJSIP/101", state.Unknown, state.NotInUse}},
+			wantCache:   map[string]state.State{"101": state.NotInUse},
+		},
+		{
+			name: "devices of one extension roll up",
+			events: []map[string]string{
+				{"Event": "DeviceStateChange", "Device": "PJSIP/101", "State": "INUSE"},
+				{"Event": "DeviceStateChange", "Device": "PJSIP/101-soft", "State": "RINGING"},
+			},
+			wantUpdates: []update{
+				{"PJSIP/101", state.Unknown, state.InUse},
+				{"PJSIP/101-soft", state.InUse, state.RingInUse},
+			},
+			wantCache: map[string]state.State{"101": state.RingInUse},
+		},
+		{
+			name:        "unknown state name",
+			events:      []map[string]string{{"Event": "DeviceStateChange", "Device": "PJSIP/101", "State": "SLEEPING"}},
+			wantUpdates: []update{{"PJSIP/101", state.Unknown, state.Unknown}},
+			wantCache:   map[string]state.State{"101": state.Unknown},
+		},
+		{
+			name:      "unmapped device",
+			events:    []map[string]string{{"Event": "DeviceStateChange", "Device": "Queue:support", "State": "INUSE"}},
+			wantCache: map[string]state.State{},
+		},
+		{
+			name:      "other event",
+			events:    []map[string]string{{"Event": "PeerStatus", "Device": "PJSIP/101", "State": "INUSE"}},
+			wantCache: map[string]state.State{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := state.NewCache()
+			var updates []update
+			in := New(cache, pjsipMapper, ListenerFunc(func(device string, previous state.State, endpoint state.Endpoint) {
+				updates = append(updates, update{device, previous, endpoint.Status})
+			}))
+			for _, event := range tt.events {
+				in.HandleEvent(event)
+			}
+
+			if len(updates) != len(tt.wantUpdates) {
+				t.Fatalf("updates = %v, want %v", updates, tt.wantUpdates)
+			}
+			for i := range updates {
+				if updates[i] != tt.wantUpdates[i] {
+					t.Errorf("update %d = %v, want %v", i, updates[i], tt.wantUpdates[i])
+				}
+			}
+			got := make(map[string]state.State)
+			for _, e := range cache.List(func(string) bool { return true }, false) {
+				got[e.Extension] = e.Status
+			}
+			if len(got) != len(tt.wantCache) {
+				t.Errorf("cache = %v, want %v", got, tt.wantCache)
+			}
+			for ext, want := range tt.wantCache {
+				if got[ext] != want {
+					t.Errorf("cache[%s] = %s, want %s", ext, got[ext], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleEventWithoutListener(t *testing.T) {
+	cache := state.NewCache()
+	New(cache, pjsipMapper, nil).HandleEvent(map[string]string{"Event": "DeviceStateChange", "Device": "PJSIP/101", "State": "BUSY"})
+	if e, _ := cache.Snapshot("101"); e.Status != state.Busy {
+		t.Errorf("status = %s, want %s", e.Status, state.Busy)
+	}
+}
+
+// fakeAMI answers DeviceStateList by sending events on the event channel
+type fakeAMI struct {
+	events []map[string]string
+	ch     chan map[string]string
+}
+
+func (a *fakeAMI) SetEventChannel(c chan map[string]string) {
+	a.ch = c
+}
+
+func (a *fakeAMI) Action(action map[string]string) (map[string]string, error) {
+	go func(ch chan map[string]string) {
+		for _, event := range a.events {
+			ch <- event
+		}
+	}(a.ch)
+	return map[string]string{"Response": "Success", "ActionID": action["ActionID"]}, nil
+}
+
+func TestLoadStates(t *testing.T) {
+	ami := &fakeAMI{events: []map[string]string{
+		{"Event": "DeviceState", "Device": "PJSIP/101", "State": "NOT_INUSE"},
+		{"Event": "DeviceState", "Device": "PJSIP/102", "State": "UNAVAILABLE"},
+		{"Event": "DeviceState", "Device": "Queue:support", "State": "INUSE"},
+		{"Event": "DeviceStateListComplete", "ListItems": "3"},
+	}}
+	cache := state.NewCache()
+	if err := New(cache, pjsipMapper, nil).LoadStates(ami, time.Second); err != nil {
+		t.Fatalf("LoadStates: %v", err)
+	}
+	if ami.ch != nil {
+		t.Error("event channel left set")
+	}
+	for ext, want := range map[string]state.State{"101": state.NotInUse, "102": state.Unavailable} {
+		if e, _ := cache.Snapshot(ext); e.Status != want {
+			t.Errorf("%s: status = %s, want %s", ext, e.Status, want)
+		}
+	}
+}
+
+func TestLoadStatesTimeout(t *testing.T) {
+	ami := &fakeAMI{events: []map[string]string{
+		{"Event": "DeviceState", "Device": "PJSIP/101", "State": "NOT_INUSE"},
+	}}
+	err := New(state.NewCache(), pjsipMapper, nil).LoadStates(ami, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("LoadStates succeeded without DeviceStateListComplete")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"sipblf/state"
+)
+
+// registerInjectRoutes adds the admin API for injecting device states. An
+// injected state goes through the same pipeline as one from Asterisk, so it
+// updates the cache, history, alerts, webhooks, MQTT, Redis and clients.
+// The API only answers when server.inject_events is set, which is only
+// allowed in development mode.
+func registerInjectRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/admin/inject", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		if !cfg.Server.InjectEvents || cfg.Server.Mode != "development" {
+			http.NotFound(w, r)
+			return
+		}
+		if ingestOnly(w, "Injecting device states") {
+			return
+		}
+
+		var req struct {
+			Device string `json:"device"`
+			State  string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		s, ok := state.Lookup(req.State)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown state %q", req.State), http.StatusBadRequest)
+			return
+		}
+		ext, ok := deviceExtension(req.Device)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Device %q does not map to an extension", req.Device), http.StatusBadRequest)
+			return
+		}
+
+		slog.Info("Device state injected", "audit", "inject", "device", req.Device, "state", s, "client_ip", clientIP(r))
+		ingester.HandleEvent(map[string]string{
+			"Event":  "DeviceStateChange",
+			"Device": req.Device,
+			"State":  req.State,
+		})
+		endpoint, _ := extensionCache.Snapshot(ext)
+		writeJSON(w, http.StatusOK, endpoint)
+	}))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminAccount is the account name used for per-account rate limiting and
+// audit entries. There is only one admin password, so there is only one account.
+const adminAccount = "admin"
+
+// LoginLimiter tracks failed login attempts per client IP and per account and
+// locks out a key once it exceeds its threshold. Each successive lockout of
+// the same key doubles in length, up to a maximum.
+type LoginLimiter struct {
+	mu              sync.Mutex
+	attempts        map[string]*loginAttempts
+	maxIPFailures   int
+	maxAcctFailures int
+	window          time.Duration
+	lockout         time.Duration
+	maxLockout      time.Duration
+	// now returns the current time; tests replace it
+	now func() time.Time
+}
+
+// loginAttempts stores the failure history for a single IP or account
+type loginAttempts struct {
+	failures     int
+	firstFailure time.Time
+	lastFailure  time.Time
+	lockouts     int
+	lockedUntil  time.Time
+}
+
+// NewLoginLimiter creates a login limiter with the configured thresholds
+func NewLoginLimiter(c LoginConfig) *LoginLimiter {
+	return &LoginLimiter{
+		attempts:        make(map[string]*loginAttempts),
+		maxIPFailures:   c.MaxFailuresIP,
+		maxAcctFailures: c.MaxFailuresAccount,
+		window:          c.FailureWindow,
+		lockout:         c.Lockout,
+		maxLockout:      c.LockoutMax,
+		now:             time.Now,
+	}
+}
+
+// Update applies new thresholds. Existing failure counts and lockouts are kept.
+func (l *LoginLimiter) Update(c LoginConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxIPFailures = c.MaxFailuresIP
+	l.maxAcctFailures = c.MaxFailuresAccount
+	l.window = c.FailureWindow
+	l.lockout = c.Lockout
+	l.maxLockout = c.LockoutMax
+}
+
+// Check reports whether a login attempt from ip against account may proceed.
+// If not, it returns how long the caller must wait before trying again.
+// A locked account only turns away IPs with recent failures of their own, so
+// guesses spread over many addresses cannot lock the admin out of a browser
+// that has not been guessing.
+func (l *LoginLimiter) Check(ip, account string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	keys := []string{"ip:" + ip}
+	if a, ok := l.attempts["ip:"+ip]; ok && now.Sub(a.lastFailure) <= l.window {
+		keys = append(keys, "account:"+account)
+	}
+	var wait time.Duration
+	for _, key := range keys {
+		if a, ok := l.attempts[key]; ok && now.Before(a.lockedUntil) {
+			if remaining := a.lockedUntil.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait == 0, wait
+}
+
+// Fail records a failed login attempt and returns the lockout applied, if any
+func (l *LoginLimiter) Fail(ip, account string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	ipLock := l.fail("ip:"+ip, l.maxIPFailures, now)
+	acctLock := l.fail("account:"+account, l.maxAcctFailures, now)
+	if acctLock > ipLock {
+		return acctLock
+	}
+	return ipLock
+}
+
+// Succeed clears the failure history for ip and account after a successful
+// login, lifting any account lock
+func (l *LoginLimiter) Succeed(ip, account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, "ip:"+ip)
+	delete(l.attempts, "account:"+account)
+}
+
+func (l *LoginLimiter) fail(key string, max int, now time.Time) time.Duration {
+	a, ok := l.attempts[key]
+	if !ok {
+		a = &loginAttempts{}
+		l.attempts[key] = a
+	}
+
+	// Start a fresh window if the previous failures have aged out
+	if now.Sub(a.firstFailure) > l.window {
+		a.failures = 0
+		a.firstFailure = now
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if max <= 0 || a.failures < max {
+		return 0
+	}
+
+	// Threshold reached: lock out with exponential backoff
+	a.failures = 0
+	a.lockouts++
+	lockout := l.lockout
+	for i := 1; i < a.lockouts && lockout < l.maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > l.maxLockout {
+		lockout = l.maxLockout
+	}
+	a.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// Cleanup periodically removes entries that are neither locked nor have recent failures
+func (l *LoginLimiter) Cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		now := l.now()
+		for key, a := range l.attempts {
+			if now.After(a.lockedUntil) && now.Sub(a.lastFailure) > l.window {
+				delete(l.attempts, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// auditLogin writes a structured audit record for a login attempt
+func auditLogin(r *http.Request, outcome string, attrs ...any) {
+	attrs = append([]any{
+		"audit", "login",
+		"outcome", outcome,
+		"account", adminAccount,
+		"client_ip", clientIP(r),
+		"user_agent", r.UserAgent(),
+	}, attrs...)
+	slog.Info("Login attempt", attrs...)
+}
+
+// trustedProxies lists the reverse proxies whose forwarding headers are
+// believed
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// parseProxy parses a trusted proxy given as an address or a CIDR range
+func parseProxy(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// setTrustedProxies replaces the trusted proxy list. Blank entries are
+// ignored; if any other entry is invalid the list is left unchanged.
+func setTrustedProxies(proxies []string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		prefix, err := parseProxy(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	trustedProxies.Store(&prefixes)
+	return nil
+}
+
+// isTrustedProxy reports whether ip is one of the trusted proxies
+func isTrustedProxy(ip string) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the connection's peer without the
+// ephemeral port, so every connection from a host shares one key
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// clientIP returns the originating client address. Forwarding headers are
+// only believed when the connection comes from a trusted proxy, as anyone
+// else can set them to whatever they like.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from, so walk
+	// X-Forwarded-For back from the nearest hop to the first untrusted one
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	for _, header := range []string{"X-Real-IP", "CF-Connecting-IP"} {
+		if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+			return v
+		}
+	}
+	return ip
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testLimiter returns a limiter whose clock only moves when the test moves it
+func testLimiter(c LoginConfig) (*LoginLimiter, *time.Time) {
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	l := NewLoginLimiter(c)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	cfg := LoginConfig{
+		MaxFailuresIP:      3,
+		MaxFailuresAccount: 100,
+		FailureWindow:      15 * time.Minute,
+		Lockout:            time.Minute,
+		LockoutMax:         4 * time.Minute,
+	}
+	type step struct {
+		// advance moves the clock before the attempt
+		advance  time.Duration
+		wantLock time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"locks on the threshold", []step{
+			{0, 0}, {0, 0}, {0, time.Minute},
+		}},
+		{"lockouts double up to the maximum", []step{
+			{0, 0}, {0, 0}, {0, time.Minute},
+			{time.Minute, 0}, {0, 0}, {0, 2 * time.Minute},
+			{2 * time.Minute, 0}, {0, 0}, {0, 4 * time.Minute},
+			{4 * time.Minute, 0}, {0, 0}, {0, 4 * time.Minute},
+		}},
+		{"failures outside the window start again", []step{
+			{0, 0}, {0, 0},
+			{16 * time.Minute, 0}, {0, 0}, {0, time.Minute},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, now := testLimiter(cfg)
+			for i, s := range tt.steps {
+				*now = now.Add(s.advance)
+				if ok, wait := l.Check("192.0.2.1", adminAccount); !ok {
+					t.Fatalf("step %d: locked for %v before failing", i, wait)
+				}
+				if got := l.Fail("192.0.2.1", adminAccount); got != s.wantLock {
+					t.Errorf("step %d: lockout %v, want %v", i, got, s.wantLock)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginLimiterExpiry(t *testing.T) {
+	l, now := testLimiter(LoginConfig{
+		MaxFailuresIP:      2,
+		MaxFailuresAccount: 3,
+		FailureWindow:      15 * time.Minute,
+		Lockout:            time.Minute,
+		LockoutMax:         time.Hour,
+	})
+	l.Fail("192.0.2.1", adminAccount)
+	l.Fail("192.0.2.1", adminAccount)
+	l.Fail("192.0.2.2", adminAccount)
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		ip      string
+		want    bool
+	}{
+		{"locked IP", 0, "192.0.2.1", false},
+		{"IP with failures under a locked account", 0, "192.0.2.2", false},
+		{"IP without failures under a locked account", 0, "192.0.2.3", true},
+		{"locked IP just before expiry", 59 * time.Second, "192.0.2.1", false},
+		{"locked IP after expiry", time.Second, "192.0.2.1", true},
+		{"other IP after the account lock expires", 0, "192.0.2.2", true},
+	}
+	for _, tt := range tests {
+		*now = now.Add(tt.advance)
+		if ok, wait := l.Check(tt.ip, adminAccount); ok != tt.want {
+			t.Errorf("%s: allowed %v (wait %v), want %v", tt.name, ok, wait, tt.want)
+		}
+	}
+
+	l.Fail("192.0.2.4", adminAccount)
+	l.Fail("192.0.2.4", adminAccount)
+	if ok, _ := l.Check("192.0.2.4", adminAccount); ok {
+		t.Fatal("192.0.2.4 not locked")
+	}
+	l.Succeed("192.0.2.4", adminAccount)
+	if ok, wait := l.Check("192.0.2.4", adminAccount); !ok {
+		t.Errorf("still locked for %v after a successful login", wait)
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { setTrustedProxies(nil) })
+
+	if err := setTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTrustedProxies([]string{"192.0.2.1", "proxy.example.com"}); err == nil {
+		t.Error("no error for a host name")
+	}
+	// The failed call leaves the earlier list in place
+	for ip, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.1": true,
+		"2001:db8::1":      true,
+		"192.0.2.2":        false,
+		"garbage":          false,
+	} {
+		if got := isTrustedProxy(ip); got != want {
+			t.Errorf("isTrustedProxy(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Cleanup(func() { setTrustedProxies(nil) })
+	if err := setTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{"direct client", "192.0.2.1:5000", nil, "192.0.2.1"},
+		{"direct client forging headers", "192.0.2.1:5000", map[string][]string{
+			"X-Forwarded-For":  {"198.51.100.7"},
+			"X-Real-IP":        {"198.51.100.8"},
+			"CF-Connecting-IP": {"198.51.100.9"},
+		}, "192.0.2.1"},
+		{"trusted proxy", "127.0.0.1:5000", map[string][]string{
+			"X-Forwarded-For": {"192.0.2.1"},
+		}, "192.0.2.1"},
+		{"client prepends a forged hop", "127.0.0.1:5000", map[string][]string{
+			"X-Forwarded-For": {"198.51.100.7, 192.0.2.1"},
+		}, "192.0.2.1"},
+		{"chain of trusted proxies", "127.0.0.1:5000", map[string][]string{
+			"X-Forwarded-For": {"192.0.2.1, 10.0.0.5", "10.0.0.6"},
+		}, "192.0.2.1"},
+		{"only trusted hops", "127.0.0.1:5000", map[string][]string{
+			"X-Forwarded-For": {"10.0.0.5"},
+		}, "10.0.0.5"},
+		{"trusted proxy with X-Real-IP", "127.0.0.1:5000", map[string][]string{
+			"X-Real-IP": {"192.0.2.1"},
+		}, "192.0.2.1"},
+		{"trusted proxy without headers", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"IPv6 client", "[2001:db8::1]:5000", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/login", nil)
+			r.RemoteAddr = tt.remote
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHTTPS(t *testing.T) {
+	t.Cleanup(func() { setTrustedProxies(nil) })
+	if err := setTrustedProxies([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		want   bool
+	}{
+		{"plain HTTP", "192.0.2.1:5000", "", false},
+		{"untrusted client claiming HTTPS", "192.0.2.1:5000", "https", false},
+		{"trusted proxy forwarding HTTPS", "127.0.0.1:5000", "https", true},
+		{"trusted proxy forwarding HTTP", "127.0.0.1:5000", "http", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/login", nil)
+			r.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := isHTTPS(r); got != tt.want {
+				t.Errorf("isHTTPS = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,82 +1,111 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
 	_ "github.com/go-sql-driver/mysql" // MySQL driver
 	"github.com/ivahaev/amigo"
-	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+
+	"sipblf/broadcast"
+	"sipblf/ingest"
+	"sipblf/state"
 )
 
 //go:embed templates/* static/*
 var content embed.FS
 
+// Current configuration, replaced atomically on reload
+var appConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration in effect
+func currentConfig() *Config {
+	return appConfig.Load()
+}
+
+// Log level, adjustable on reload
+var logLevel = new(slog.LevelVar)
+
 // Initialize session manager
 var sessionManager *scs.SessionManager
 
 // Global cache for extension states
-type ExtensionCache struct {
-	mu     sync.RWMutex
-	states map[string]*Endpoint
-}
+var extensionCache = state.NewCache()
 
-var extensionCache = &ExtensionCache{
-	states: make(map[string]*Endpoint),
-}
+// Pushes state changes to SSE clients
+var globalBroadcaster = broadcast.New()
 
-var globalBroadcaster *AMIBroadcaster
-
-func DeviceStateChangeHandler(m map[string]string) {
-	// Only handle device state events for SIP/PJSIP devices
-	if device := m["Device"]; strings.HasPrefix(device, "PJSIP/") || strings.HasPrefix(device, "SIP/") {
-		// Only process state-related events
-		if event := m["Event"]; event == "DeviceStateChange" || event == "DeviceState" {
-			ext := strings.TrimPrefix(strings.TrimPrefix(device, "PJSIP/"), "SIP/")
-			state := m["State"]
-			readableState := getHumanReadableState(state)
-			// Only process numeric extensions
-			if _, err := strconv.Atoi(ext); err == nil {
-				log.Printf("State change: %s -> %s", ext, readableState) // Keep this as regular log for important state changes
-				extensionCache.mu.Lock()
-				if endpoint, exists := extensionCache.states[ext]; exists {
-					slog.Debug("Existing endpoint state change", "extension", ext, "old_state", endpoint.Status, "new_state", readableState)
-					endpoint.Status = readableState
-				} else {
-					slog.Debug("New endpoint added", "extension", ext, "state", readableState)
-					extensionCache.states[ext] = &Endpoint{
-						Extension:   ext,
-						Description: "", // Empty description for new endpoints
-						Status:      readableState,
-					}
-				}
-				extensionCache.mu.Unlock()
-
-				// Broadcast the state change to connected clients with filtering based on extension length
-				if globalBroadcaster != nil {
-					slog.Debug("Broadcasting filtered event", "extension", ext, "state", readableState)
-					slog.Debug("Connected clients", "count", globalBroadcaster.ClientCount())
-					globalBroadcaster.BroadcastFilteredEvent(ext, readableState)
-				}
-			}
-		}
+// Rate limiter for /api/login
+var loginLimiter *LoginLimiter
+
+// Read-only API tokens for wallboards and integrations
+var apiTokens *TokenStore
+
+// Cross-origin policy for /events and the API
+var corsPolicy *CORSPolicy
+
+// AMI client, used by directory sources that query Asterisk
+var amiClient *amigo.Amigo
+
+// Applies AMI device state events to the cache, nil on web processes
+var ingester *ingest.Ingester
+
+// initialLoad is set while the initial device states are loaded, when
+// state changes are held back for settleInitialStates
+var initialLoad atomic.Bool
+
+// deviceUpdated passes a device state report, already applied to the
+// cache, on to everything else that follows extension states
+func deviceUpdated(device string, previous state.State, endpoint state.Endpoint) {
+	ext, current := endpoint.Extension, endpoint.Status
+	if previous != current && !initialLoad.Load() {
+		onStateChange(state.Transition{Time: endpoint.Since, Extension: ext, Device: device, From: previous, To: current}, endpoint)
+	}
+	redisRelay.Publish(endpoint)
+	if previous == current {
+		slog.Debug("Combined state unchanged", "extension", ext, "device", device, "state", current)
+	} else {
+		slog.Debug("Endpoint state change", "extension", ext, "old_state", previous, "new_state", current)
+
+		// Broadcast the state change to connected clients with filtering based on extension length
+		slog.Debug("Broadcasting filtered event", "extension", ext, "state", current)
+		slog.Debug("Connected clients", "count", globalBroadcaster.ClientCount())
+		globalBroadcaster.BroadcastFilteredEvent(ext, current)
+		globalBroadcaster.BroadcastTimes(endpoint)
 	}
+	// Authenticated clients also see which device changed
+	globalBroadcaster.BroadcastDevices(ext, endpoint.Devices)
+}
+
+// onStateChange passes a change of an extension's combined state to
+// everything that records or reacts to state changes
+func onStateChange(t state.Transition, endpoint state.Endpoint) {
+	history.Record(t)
+	alerts.Observe(endpoint)
+	webhooks.Publish(t, endpoint)
+	mqttPublisher.PublishTransition(t, endpoint)
 }
 
+// DefaultHandler receives every AMI event. It records them to the capture,
+// if enabled, and logs the unusual ones at debug level.
 func DefaultHandler(m map[string]string) {
+	amiCapture.Record(m)
 	event := m["Event"]
 	// Skip common events and CDRPROSYNC user events
 	if event != "ChallengeSent" &&
@@ -84,379 +113,360 @@ func DefaultHandler(m map[string]string) {
 		event != "RequestBadFormat" &&
 		event != "ChallengeResponseFailed" &&
 		!strings.HasPrefix(event, "RTCP") &&
-		!(event == "UserEvent" && m["UserEvent"] == "CDRPROSYNC") {
-		fmt.Printf("Default handler: %+v\n", m)
+		!(event == "UserEvent" && m["UserEvent"] == "CDRPROSYNC") &&
+		!strings.HasPrefix(m["ActionID"], amiListPrefix) {
+		slog.Debug("Unhandled AMI event", "event", event, "fields", m)
 	}
 }
 
-// AMIBroadcaster handles broadcasting AMI events to clients
-type AMIBroadcaster struct {
-	clients map[chan string]*ClientInfo
-	mu      sync.RWMutex
+// getDirectoryEntries returns every extension known to the directory
+func getDirectoryEntries() map[string]DirectoryEntry {
+	ctx, cancel := context.WithTimeout(context.Background(), directoryLookupTimeout)
+	defer cancel()
+
+	devices := make(map[string]DirectoryEntry)
+	for ext, entry := range directory.Lookup(ctx) {
+		// Only include devices allowed as extensions
+		if isExtension(ext) {
+			devices[ext] = entry
+		}
+	}
+	return devices
 }
 
-// ClientInfo stores information about a connected client
-type ClientInfo struct {
-	Authenticated bool
+// visibleEndpoints returns the cached endpoints a client with scope may see, sorted by extension
+func visibleEndpoints(scope Scope) []state.Endpoint {
+	// Only show devices allowed as extensions
+	endpoints := extensionCache.List(func(ext string) bool {
+		return isExtension(ext) && scope.CanSee(ext)
+	}, scope.Detailed())
+
+	// Sort endpoints naturally by extension, so 2 < 10 and door2 < door10
+	sort.Slice(endpoints, func(i, j int) bool {
+		return naturalLess(endpoints[i].Extension, endpoints[j].Extension)
+	})
+	return endpoints
 }
 
-// NewAMIBroadcaster creates a new AMI broadcaster
-func NewAMIBroadcaster() *AMIBroadcaster {
-	return &AMIBroadcaster{
-		clients: make(map[chan string]*ClientInfo),
+// initializeExtensionCache fills the cache from the directory, each
+// extension in its last recorded state or else unavailable. It returns
+// the extensions as stored and which of them had recorded history.
+func initializeExtensionCache() (map[string]state.Endpoint, map[string]bool) {
+	seeded := make(map[string]state.Endpoint)
+	recorded := make(map[string]bool)
+	for ext, entry := range getDirectoryEntries() {
+		endpoint := state.Endpoint{
+			Extension:   ext,
+			Description: entry.Description,
+			Metadata:    entry.Metadata,
+			Status:      state.Unavailable,
+		}
+		recorded[ext] = seedFromHistory(&endpoint)
+		extensionCache.Replace(endpoint)
+		seeded[ext] = endpoint
 	}
+	return seeded, recorded
 }
 
-// Subscribe registers a new client channel for receiving events
-func (b *AMIBroadcaster) Subscribe(authenticated bool) (chan string, func()) {
-	// Increase buffer size to handle bursts of events better
-	events := make(chan string, 100)
-
-	b.mu.Lock()
-	b.clients[events] = &ClientInfo{
-		Authenticated: authenticated,
+// seedFromHistory restores an extension's state, and when it entered it,
+// from its last recorded transition, so a restart neither makes a
+// long-dead phone look freshly unavailable nor records every phone coming
+// back from unavailable. It reports whether the extension had history.
+func seedFromHistory(endpoint *state.Endpoint) bool {
+	if history == nil {
+		return false
 	}
-	b.mu.Unlock()
-
-	// Return the channel and an unsubscribe function
-	return events, func() {
-		b.mu.Lock()
-		delete(b.clients, events)
-		close(events)
-		b.mu.Unlock()
+	last, err := history.Last(endpoint.Extension)
+	if err != nil {
+		log.Printf("Warning: Failed to read history for %s: %v", endpoint.Extension, err)
+		return false
+	}
+	if last == nil {
+		return false
 	}
+	endpoint.Status = last.To
+	endpoint.Since = last.Time
+	if last.From.Reachable() || last.To.Reachable() {
+		endpoint.LastSeen = last.Time
+	}
+	return true
 }
 
-// ClientCount returns the number of connected clients
-func (b *AMIBroadcaster) ClientCount() int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return len(b.clients)
+// settleInitialStates passes on what changed while the initial device
+// states were loaded, once everything that reacts to changes is set up.
+// An extension whose devices are reported one at a time can pass through
+// several states on the way, so each is only compared with its state
+// before the load. A change from a recorded state goes everywhere; one
+// from an unknown state is only recorded, as nothing is known to have
+// changed.
+func settleInitialStates(seeded map[string]state.Endpoint, recorded map[string]bool) {
+	for _, endpoint := range extensionCache.List(func(string) bool { return true }, true) {
+		ext := endpoint.Extension
+		before, ok := seeded[ext]
+		if !ok {
+			// Reported by Asterisk but not in the directory
+			before = state.Endpoint{Extension: ext, Status: state.Unknown}
+			recorded[ext] = seedFromHistory(&before)
+		}
+		if endpoint.Status == before.Status {
+			// Undo any passing changes to when it entered the state
+			if !before.Since.IsZero() && !endpoint.Since.Equal(before.Since) {
+				endpoint.Since = before.Since
+				extensionCache.Replace(endpoint)
+				globalBroadcaster.BroadcastTimes(endpoint)
+			}
+			continue
+		}
+		t := state.Transition{Time: endpoint.Since, Extension: ext, From: before.Status, To: endpoint.Status}
+		if recorded[ext] {
+			onStateChange(t, endpoint)
+		} else {
+			history.Record(t)
+		}
+	}
 }
 
-// BroadcastEvent sends an event to all connected clients
-func (b *AMIBroadcaster) BroadcastEvent(event string) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
-	activeClients := 0
-	skippedClients := 0
-
-	for client := range b.clients {
-		// Use a timeout for sending to prevent complete blocking
-		select {
-		case client <- event:
-			activeClients++
-		case <-time.After(100 * time.Millisecond):
-			// If we can't send within 100ms, log it and skip
-			skippedClients++
-			log.Printf("Warning: Client buffer full, message skipped")
+// startIngest connects to Asterisk, loads the initial extension states and
+// starts everything that records or reacts to state changes
+func startIngest(cfg *Config) *amigo.Amigo {
+	var err error
+
+	// Open the state history
+	if cfg.History.Enabled {
+		history, err = OpenHistoryStore(cfg.History)
+		if err != nil {
+			log.Fatalf("Error opening history: %v", err)
 		}
 	}
 
-	if skippedClients > 0 {
-		log.Printf("Warning: Broadcast partially complete: %d active clients, %d skipped", activeClients, skippedClients)
-	} else {
-		slog.Debug("Broadcast complete", "active_clients", activeClients)
+	// Create AMI settings
+	amiSettings := &amigo.Settings{
+		Host:              cfg.AMI.Host,
+		Port:              strconv.Itoa(cfg.AMI.Port),
+		Username:          cfg.AMI.User,
+		Password:          cfg.AMI.Pass,
+		DialTimeout:       10 * time.Second,
+		ReconnectInterval: 5 * time.Second,
 	}
 
-	// Debug: print the event that was broadcast
-	slog.Debug("Broadcast event content", "event", event)
-}
+	// Capture raw events from the start if asked to
+	if err := amiCapture.Configure(cfg.Capture); err != nil {
+		log.Fatalf("Error starting AMI capture: %v", err)
+	}
+
+	// Create AMI client with settings
+	ami := amigo.New(amiSettings)
 
-// BroadcastFilteredEvent sends an event to clients based on authentication status and extension length
-func (b *AMIBroadcaster) BroadcastFilteredEvent(ext string, state string) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	// Register event handlers first
+	// Channel to signal AMI connection ready
+	amiReady := make(chan bool)
 
-	activeClients := 0
-	skippedClients := 0
-	extLen := len(ext)
+	ami.On("connect", func(message string) {
+		log.Printf("Connected: %s", message)
+		amiReady <- true
+	})
+	ami.On("error", func(message string) {
+		log.Printf("CONNECTION ERROR: %s", message)
+	})
+	ingester = ingest.New(extensionCache, ingest.MapperFunc(deviceExtension), ingest.ListenerFunc(deviceUpdated))
+	ami.RegisterHandler("DeviceStateChange", ingester.HandleEvent)
+	for _, event := range amiListEvents {
+		ami.RegisterHandler(event, amiLists.Handle)
+	}
+	ami.RegisterDefaultHandler(DefaultHandler)
 
-	for client, info := range b.clients {
-		// Only send short extensions (4 or fewer digits) to authenticated clients
-		if extLen <= 4 && !info.Authenticated {
-			continue // Skip this client
-		}
+	// Connect to AMI
+	ami.Connect()
 
-		// Format the event message
-		eventMsg := fmt.Sprintf("data: %s %s\n\n", ext, state)
-
-		// Use a timeout for sending to prevent complete blocking
-		select {
-		case client <- eventMsg:
-			activeClients++
-		case <-time.After(100 * time.Millisecond):
-			// If we can't send within 100ms, log it and skip
-			skippedClients++
-			log.Printf("Warning: Client buffer full, message skipped")
-		}
+	// Wait for AMI to be ready
+	select {
+	case <-amiReady:
+		log.Printf("AMI connection ready")
+	case <-time.After(5 * time.Second):
+		log.Printf("WARNING: Timeout waiting for AMI connection")
 	}
 
-	if skippedClients > 0 {
-		log.Printf("Warning: Filtered broadcast partially complete: %d active clients, %d skipped", activeClients, skippedClients)
-	} else {
-		slog.Debug("Filtered broadcast complete", "active_clients", activeClients)
+	// Set up the extension directory
+	if err := directory.Configure(cfg.Directory.Sources, ami); err != nil {
+		log.Fatalf("Error configuring directory: %v", err)
 	}
+	amiClient = ami
 
-	// Debug: print the event that was broadcast
-	slog.Debug("Broadcast filtered event", "extension", ext, "state", state)
-}
+	// Initialize extension cache first
+	seeded, recorded := initializeExtensionCache()
+	slog.Debug("Extension cache initialized with descriptions")
+	for _, endpoint := range visibleEndpoints(ScopeAll) {
+		slog.Debug("Extension description", "extension", endpoint.Extension, "description", endpoint.Description)
+	}
 
-// Endpoint represents a phone extension
-type Endpoint struct {
-	Extension   string
-	Description string
-	Status      string
-	Disabled    bool
-}
+	// Request initial device states, holding back the changes they make
+	// until everything that reacts to them is running
+	initialLoad.Store(true)
+	if err := ingester.LoadStates(ami, 10*time.Second); err != nil {
+		log.Printf("Error loading device states: %v", err)
+	}
 
-func getDeviceDescriptions() (map[string]string, error) {
-	devices := make(map[string]string)
+	// Keep descriptions in step with the database
+	go runDescriptionSync()
 
-	// If DB_HOST is not defined, return empty descriptions
-	if os.Getenv("DB_HOST") == "" {
-		return devices, nil
+	// Start alerting, picking up conditions that already hold
+	if err := alerts.Configure(cfg.Alerts); err != nil {
+		log.Fatalf("Error configuring alerts: %v", err)
 	}
+	go alerts.Run()
 
-	// Connect to MySQL
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASS"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_NAME")))
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	if err := webhooks.Configure(cfg.Webhooks); err != nil {
+		log.Fatalf("Error configuring webhooks: %v", err)
 	}
-	defer db.Close()
 
-	// Query device descriptions
-	rows, err := db.Query("SELECT id, description FROM devices")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query devices: %v", err)
+	// Mirror states to MQTT, once the cache has them all
+	if cfg.MQTT.Broker != "" {
+		mqttPublisher = NewMQTTPublisher(cfg.MQTT)
 	}
-	defer rows.Close()
 
-	// Process results
-	for rows.Next() {
-		var id, description string
-		if err := rows.Scan(&id, &description); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
-		}
-		// Only include numeric extensions
-		if _, err := strconv.Atoi(id); err == nil {
-			devices[id] = description
+	// Share states with web processes
+	if cfg.Redis.URL != "" {
+		redisRelay, err = NewRedisRelay(cfg.Redis)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
 		}
+		go redisRelay.RunIngest()
 	}
 
-	return devices, nil
+	settleInitialStates(seeded, recorded)
+	initialLoad.Store(false)
+	return ami
+
 }
 
-// Initialize extension cache with descriptions and default states
-func initializeExtensionCache() error {
-	descriptions, err := getDeviceDescriptions()
+func main() {
+	// Load configuration from file, environment and flags
+	opts, err := parseFlags(os.Args[1:])
 	if err != nil {
-		return fmt.Errorf("failed to get device descriptions: %v", err)
+		os.Exit(2)
 	}
-
-	extensionCache.mu.Lock()
-	defer extensionCache.mu.Unlock()
-
-	// Initialize cache with descriptions
-	for ext, desc := range descriptions {
-		extensionCache.states[ext] = &Endpoint{
-			Extension:   ext,
-			Description: desc,
-			Status:      "Unavailable",
+	if opts.Demo {
+		if err := startDemo(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Demo mode: %v\n", err)
+			os.Exit(1)
 		}
 	}
-
-	return nil
-}
-
-// Helper function to convert device state to human readable format
-func getHumanReadableState(state string) string {
-	switch strings.ToUpper(state) {
-	case "INUSE":
-		return "In use"
-	case "NOT_INUSE", "IDLE":
-		return "Not in use"
-	case "RINGING":
-		return "Ringing"
-	case "BUSY":
-		return "Busy"
-	case "UNAVAILABLE", "INVALID", "UNKNOWN", "":
-		return "Unavailable"
-	default:
-		return "Unknown"
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
 	}
-}
-
-func main() {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	if opts.Demo && cfg.Server.AdminPassword == opts.demoPassword {
+		log.Printf("Demo mode: no admin password is configured, log in with %s", opts.demoPassword)
 	}
-	
-	// Configure slog based on DEBUG environment variable
-	logLevel := slog.LevelInfo
-	if os.Getenv("DEBUG") != "" {
-		logLevel = slog.LevelDebug
+	if opts.CheckConfig {
+		out, _ := yaml.Marshal(cfg.Redacted())
+		fmt.Printf("%s\nConfiguration OK\n", out)
+		return
 	}
-	
+
+	appConfig.Store(cfg)
+
+	// Configure slog based on the debug setting
+	setLogLevel(cfg.Debug)
+	setExtensionPattern(cfg.Extensions.Pattern)
+	setPublicPattern(cfg.Extensions.PublicPattern)
+
 	// Create a text handler with the appropriate level
 	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: logLevel,
 	})
-	
+
 	// Set the default logger
 	slog.SetDefault(slog.New(handler))
 
-	// Initialize extension cache
-	if err := initializeExtensionCache(); err != nil {
-		log.Printf("Warning: Failed to initialize extension cache: %v", err)
+	// Create the directory for the session, token and history files
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+			log.Fatalf("Error creating data directory: %v", err)
+		}
 	}
 
 	// Initialize session manager
 	sessionManager = scs.New()
+	sessionStore, err := newSessionStore(cfg.Session)
+	if err != nil {
+		log.Fatalf("Error creating session store: %v", err)
+	}
+	sessionManager.Store = sessionStore
 	sessionManager.Lifetime = 24 * time.Hour
 	// Set secure cookie options
-	sessionManager.Cookie.Secure = true
+	sessionManager.Cookie.Secure = cfg.SecureCookie()
+	if !sessionManager.Cookie.Secure {
+		log.Printf("Warning: Session cookie is not marked Secure; use only for local development")
+	}
 	sessionManager.Cookie.HttpOnly = true
 	sessionManager.Cookie.SameSite = http.SameSiteStrictMode
 
-	// Create AMI broadcaster
-	globalBroadcaster = NewAMIBroadcaster()
-
-	// Create AMI settings
-	amiSettings := &amigo.Settings{
-		Host:              os.Getenv("AMI_HOST"),
-		Port:              os.Getenv("AMI_PORT"),
-		Username:          os.Getenv("AMI_USER"),
-		Password:          os.Getenv("AMI_PASS"),
-		DialTimeout:       10 * time.Second,
-		ReconnectInterval: 5 * time.Second,
+	// Create login rate limiter
+	loginLimiter = NewLoginLimiter(cfg.Login)
+	go loginLimiter.Cleanup(5 * time.Minute)
+	if err := setTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Error configuring trusted proxies: %v", err)
 	}
 
-	// Create AMI client with settings
-	ami := amigo.New(amiSettings)
-
-	// Register event handlers first
-	// Channel to signal AMI connection ready
-	amiReady := make(chan bool)
-
-	ami.On("connect", func(message string) {
-		log.Printf("Connected: %s", message)
-		amiReady <- true
-	})
-	ami.On("error", func(message string) {
-		log.Printf("CONNECTION ERROR: %s", message)
-	})
-	ami.RegisterHandler("DeviceStateChange", DeviceStateChangeHandler)
-	ami.RegisterDefaultHandler(DefaultHandler)
-
-	// Connect to AMI
-	ami.Connect()
-	defer ami.Close()
-
-	// Wait for AMI to be ready
-	select {
-	case <-amiReady:
-		log.Printf("AMI connection ready")
-	case <-time.After(5 * time.Second):
-		log.Printf("WARNING: Timeout waiting for AMI connection")
+	// Load API tokens
+	apiTokens, err = NewTokenStore(cfg.Tokens.File, []byte(cfg.Tokens.SigningKey))
+	if err != nil {
+		log.Fatalf("Error loading API tokens: %v", err)
 	}
+	go apiTokens.SaveLastUsed(lastUsedSaveInterval)
 
-	// Initialize extension cache first
-	if err := initializeExtensionCache(); err != nil {
-		log.Printf("Error initializing extension cache: %v", err)
-	} else {
-		slog.Debug("Extension cache initialized with descriptions")
-		extensionCache.mu.RLock()
-		for ext, endpoint := range extensionCache.states {
-			slog.Debug("Extension description", "extension", ext, "description", endpoint.Description)
+	if cfg.Role == "web" {
+		// Follow the ingest process through Redis instead of Asterisk
+		redisRelay, err = NewRedisRelay(cfg.Redis)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
 		}
-		extensionCache.mu.RUnlock()
-	}
-
-	// Create a channel to receive device state events
-	eventChan := make(chan map[string]string, 100)
-	ami.SetEventChannel(eventChan)
-
-	// Request initial device states
-	log.Printf("Requesting initial device states")
-	resp, err := ami.Action(map[string]string{"Action": "DeviceStateList", "ActionID": "init"})
-	log.Printf("DeviceStateList response: %+v", resp)
-	if err != nil {
-		log.Printf("Error getting device states: %v", err)
+		redisRelay.Load()
+		go redisRelay.RunWeb()
+		log.Printf("Note: API tokens and login rate limits are kept per process and not shared with other sipblf processes")
 	} else {
-		// Wait for events and process them
-		timeout := time.After(10 * time.Second) // Increased timeout for initial state gathering
-	deviceLoop:
-		for {
-			select {
-			case event := <-eventChan:
-				// Check if this is a DeviceState or DeviceStateChange event
-				if event["Event"] == "DeviceState" || event["Event"] == "DeviceStateChange" {
-					device := event["Device"]
-					state := strings.ToUpper(event["State"])
-					log.Printf("Got device state: %s = %s", device, state)
-					if device != "" && (strings.HasPrefix(device, "PJSIP/") || strings.HasPrefix(device, "SIP/")) {
-						ext := strings.TrimPrefix(strings.TrimPrefix(device, "PJSIP/"), "SIP/")
-						// Skip non-numeric extensions
-						_, err := strconv.Atoi(ext)
-						if err != nil {
-							continue
-						}
-						extensionCache.mu.Lock()
-						if endpoint, exists := extensionCache.states[ext]; exists {
-							readableState := getHumanReadableState(state)
-							log.Printf("Updating existing endpoint %s: %s -> %s", ext, endpoint.Status, readableState)
-							endpoint.Status = readableState
-						} else {
-							readableState := getHumanReadableState(state)
-							log.Printf("Creating new endpoint %s with state %s", ext, readableState)
-							extensionCache.states[ext] = &Endpoint{
-								Extension: ext,
-								Status:    getHumanReadableState(state),
-							}
-						}
-						extensionCache.mu.Unlock()
-					}
-				} else if event["Event"] == "DeviceStateListComplete" {
-					// All device states received
-					log.Printf("Device state list complete")
-					// Broadcast all current states to clients with filtering
-					extensionCache.mu.RLock()
-					for ext, endpoint := range extensionCache.states {
-						log.Printf("Broadcasting initial state for extension %s with state %s", ext, endpoint.Status)
-						globalBroadcaster.BroadcastFilteredEvent(ext, endpoint.Status)
-					}
-					extensionCache.mu.RUnlock()
-					break deviceLoop
-				}
-			case <-timeout:
-				// Timeout waiting for events
-				log.Printf("Timeout waiting for device states")
-				break deviceLoop
-			}
-		}
+		ami := startIngest(cfg)
+		defer ami.Close()
 	}
 
-	// Stop receiving events
-	ami.SetEventChannel(nil)
-
 	// Log current states in readable format
-	extensionCache.mu.RLock()
 	slog.Debug("Current device states")
-	for ext, endpoint := range extensionCache.states {
-		slog.Debug("Extension state", "extension", ext, "status", endpoint.Status, "description", endpoint.Description)
+	for _, endpoint := range visibleEndpoints(ScopeAll) {
+		slog.Debug("Extension state", "extension", endpoint.Extension, "status", endpoint.Status, "description", endpoint.Description)
 	}
-	extensionCache.mu.RUnlock()
 
 	// Set up HTTP routes
 	mux := http.NewServeMux()
 
+	// API token management and read-only JSON API
+	registerTokenRoutes(mux)
+	registerReloadRoutes(mux, opts)
+	registerHistoryRoutes(mux)
+	registerReportRoutes(mux)
+	registerWebhookRoutes(mux)
+	registerCaptureRoutes(mux)
+	registerInjectRoutes(mux)
+
+	mux.HandleFunc("/api/extensions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		scope, err := requestScope(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, visibleEndpoints(scope))
+	})
+
+	// CSRF token for scripted clients that do not load the page
+	mux.HandleFunc("/api/csrf", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"token": csrfToken(w, r)})
+	})
+
 	// Login handler
 	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -464,6 +474,15 @@ func main() {
 			return
 		}
 
+		// Refuse attempts from locked-out clients before looking at the password
+		ip := clientIP(r)
+		if ok, wait := loginLimiter.Check(ip, adminAccount); !ok {
+			auditLogin(r, "locked_out", "retry_after", wait.Round(time.Second).String())
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+			return
+		}
+
 		var loginData struct {
 			Password string `json:"password"`
 		}
@@ -473,14 +492,28 @@ func main() {
 			return
 		}
 
-		// Check password against environment variable
-		if loginData.Password != os.Getenv("ADMIN_PASSWORD") {
+		// Check password against configuration
+		adminPassword := currentConfig().Server.AdminPassword
+		if adminPassword == "" || subtle.ConstantTimeCompare([]byte(loginData.Password), []byte(adminPassword)) != 1 {
+			if lockout := loginLimiter.Fail(ip, adminAccount); lockout > 0 {
+				auditLogin(r, "failure", "lockout", lockout.String())
+			} else {
+				auditLogin(r, "failure")
+			}
 			http.Error(w, "Invalid password", http.StatusUnauthorized)
 			return
 		}
 
-		// Create session
+		// Create session, renewing the token to prevent session fixation
+		if err := sessionManager.RenewToken(r.Context()); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		sessionManager.Put(r.Context(), "authenticated", true)
+		// Keep the token the page already holds, now bound to the session
+		sessionManager.Put(r.Context(), "csrf_token", expectedCSRFToken(r))
+		loginLimiter.Succeed(ip, adminAccount)
+		auditLogin(r, "success")
 
 		w.WriteHeader(http.StatusOK)
 	})
@@ -510,7 +543,19 @@ func main() {
 	})
 
 	// Handle main page
-	tmpl := template.Must(template.ParseFS(content, "templates/index.html"))
+	tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		// rfc3339 formats a time for scripts, empty if unknown
+		"rfc3339": func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.UTC().Format(time.RFC3339)
+		},
+	}).ParseFS(content, "templates/index.html"))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
@@ -518,226 +563,71 @@ func main() {
 		}
 
 		// Check authentication
-		authenticated := sessionManager.GetBool(r.Context(), "authenticated")
-		slog.Debug("Authentication status", "authenticated", authenticated)
-
-		// Create endpoint list from cache
-		endpoints := []Endpoint{}
-		extensionCache.mu.RLock()
-		for _, endpoint := range extensionCache.states {
-			// Only show numeric extensions
-			if _, err := strconv.Atoi(endpoint.Extension); err == nil {
-				// Show all extensions if authenticated, otherwise only show extensions longer than 4 digits
-				if authenticated || len(endpoint.Extension) > 4 {
-					endpoints = append(endpoints, *endpoint)
-				}
-			}
+		scope, err := requestScope(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
 		}
-		extensionCache.mu.RUnlock()
-
-		// Sort endpoints numerically by extension
-		sort.Slice(endpoints, func(i, j int) bool {
-			// Convert extensions to integers for comparison
-			num1, err1 := strconv.Atoi(endpoints[i].Extension)
-			num2, err2 := strconv.Atoi(endpoints[j].Extension)
-			// If conversion fails, fall back to string comparison
-			if err1 != nil || err2 != nil {
-				return endpoints[i].Extension < endpoints[j].Extension
-			}
-			return num1 < num2
-		})
+		slog.Debug("Request scope", "scope", scope)
 
-		// Get UI customization from environment variables or use defaults
-		pageTitle := os.Getenv("PAGE_TITLE")
-		if pageTitle == "" {
-			pageTitle = "SIP Status"
-		}
+		// Create endpoint list from cache
+		endpoints := visibleEndpoints(scope)
 
-		brandImage := os.Getenv("BRAND_IMAGE")
-		if brandImage == "" {
-			brandImage = "/static/img/dvnz-96x96.png"
-		}
+		// UI customization comes from the configuration
+		ui := currentConfig().UI
 
-		brandAlt := os.Getenv("BRAND_ALT")
-		if brandAlt == "" {
-			brandAlt = "Digital Voice NZ Logo"
+		// Collect metadata field names for the group-by selector
+		keySet := make(map[string]bool)
+		for _, endpoint := range endpoints {
+			for key := range endpoint.Metadata {
+				keySet[key] = true
+			}
 		}
-
-		voipImage := os.Getenv("VOIP_IMAGE")
-		if voipImage == "" {
-			voipImage = "/static/img/voip.png"
-		}
-
-		voipAlt := os.Getenv("VOIP_ALT")
-		if voipAlt == "" {
-			voipAlt = "Stylized VoIP phone with HT as handset"
+		metadataKeys := make([]string, 0, len(keySet))
+		for key := range keySet {
+			metadataKeys = append(metadataKeys, key)
 		}
+		sort.Strings(metadataKeys)
 
 		tmpl.Execute(w, map[string]interface{}{
-			"Endpoints":  endpoints,
-			"PageTitle":  pageTitle,
-			"BrandImage": brandImage,
-			"BrandAlt":   brandAlt,
-			"VoipImage":  voipImage,
-			"VoipAlt":    voipAlt,
+			"Endpoints":    endpoints,
+			"MetadataKeys": metadataKeys,
+			"PageTitle":    ui.PageTitle,
+			"BrandImage":   ui.BrandImage,
+			"BrandAlt":     ui.BrandAlt,
+			"VoipImage":    ui.VoipImage,
+			"VoipAlt":      ui.VoipAlt,
+			"StaleAfter":   int(ui.StaleAfter.Seconds()),
+			"CSRFToken":    csrfToken(w, r),
 		})
 	})
 
 	// Handle SSE endpoint
-	// Test endpoint to trigger a state update
-	mux.HandleFunc("/test-update", func(w http.ResponseWriter, r *http.Request) {
-		ext := r.URL.Query().Get("ext")
-		state := r.URL.Query().Get("state")
-		if ext == "" {
-			ext = "12345"
-		}
-		if state == "" {
-			state = "In use"
-		}
-
-		log.Printf("Manual test update for extension %s to state %s", ext, state)
-
-		// Broadcast to clients with filtering based on extension length
-		if globalBroadcaster != nil {
-			slog.Debug("Test broadcast", "extension", ext, "state", state)
-			globalBroadcaster.BroadcastFilteredEvent(ext, state)
-		}
-
-		fmt.Fprintf(w, "Sent update for extension %s with state %s", ext, state)
-	})
-
 	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
 		// Get client info for logging - check common proxy headers
-		clientIP := r.Header.Get("X-Forwarded-For")
-		if clientIP == "" {
-			clientIP = r.Header.Get("X-Real-IP")
-		}
-		if clientIP == "" {
-			clientIP = r.Header.Get("CF-Connecting-IP") // Cloudflare
-		}
-		if clientIP == "" {
-			clientIP = r.RemoteAddr
-		}
-		// If X-Forwarded-For contains multiple IPs, use the first one (original client)
-		if idx := strings.Index(clientIP, ","); idx != -1 {
-			clientIP = strings.TrimSpace(clientIP[:idx])
-		}
+		clientIP := clientIP(r)
 		log.Printf("New SSE connection from %s", clientIP)
 
-		// Set headers for SSE
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow cross-origin requests
-		w.Header().Set("X-Accel-Buffering", "no")
-
-		slog.Debug("SSE headers set", "client_ip", clientIP)
-
-		// Check if user is authenticated
-		isAuthenticated := sessionManager.GetBool(r.Context(), "authenticated")
-
-		// Subscribe to AMI events using broadcaster
-		events, unsubscribe := globalBroadcaster.Subscribe(isAuthenticated)
-		defer unsubscribe()
-
-		// Send current state of all extensions to the new client
-		extensionCache.mu.RLock()
-		slog.Debug("Sending initial states", "client_ip", clientIP)
-		for ext, endpoint := range extensionCache.states {
-			// Only send extensions under 5 digits if authenticated
-			if endpoint.Status != "" && (isAuthenticated || len(ext) >= 5) {
-				stateMsg := fmt.Sprintf("%s %s", ext, endpoint.Status)
-				msg := fmt.Sprintf("data: %s\n\n", stateMsg)
-				slog.Debug("Sending initial state", "client_ip", clientIP, "extension", ext, "status", endpoint.Status)
-				fmt.Fprint(w, msg)
-				w.(http.Flusher).Flush()
-			}
-		}
-		extensionCache.mu.RUnlock()
-		slog.Debug("Finished sending initial states", "client_ip", clientIP)
-
-		// Send initial connection message
-		initialMsg := "data: Connected to updates\n\n"
-		fmt.Fprint(w, initialMsg)
-		w.(http.Flusher).Flush()
-		slog.Debug("Sent initial message", "client_ip", clientIP, "message", initialMsg)
-
-		// Start keep-alive ticker
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-
-		// Handle events and keep-alive
-		for {
-			select {
-			case <-r.Context().Done():
-				log.Printf("Client %s context done", clientIP)
-				return
-			case event := <-events:
-				// Check if this is a direct broadcast message (already formatted as SSE)
-				if strings.HasPrefix(event, "data: ") {
-					slog.Debug("Forwarding direct SSE message", "client_ip", clientIP, "event", event)
-					fmt.Fprint(w, event)
-					w.(http.Flusher).Flush()
-					slog.Debug("Sent direct update", "client_ip", clientIP)
-				} else if strings.Contains(event, "DeviceStateChange") {
-					parts := strings.Split(event, "\r\n")
-					var device, state string
-					for _, part := range parts {
-						if strings.HasPrefix(part, "Device: ") {
-							device = strings.TrimPrefix(part, "Device: ")
-						} else if strings.HasPrefix(part, "State: ") {
-							state = strings.TrimPrefix(part, "State: ")
-						}
-					}
-					if device != "" && state != "" {
-						// Convert AMI state to display state
-						displayState := "Not in use"
-						switch state {
-						case "INUSE":
-							displayState = "In use"
-						case "RINGING":
-							displayState = "Ringing"
-						case "UNAVAILABLE":
-							displayState = "Unavailable"
-						case "INVALID":
-							displayState = "Invalid"
-						}
-						// Extract extension from device path
-						ext := strings.TrimPrefix(strings.TrimPrefix(device, "PJSIP/"), "SIP/")
-						// Only send updates for extensions >= 5 digits if not authenticated
-						if isAuthenticated || len(ext) >= 5 {
-							msg := fmt.Sprintf("data: %s %s\n\n", ext, displayState)
-							slog.Debug("Sending SSE event", "client_ip", clientIP, "message", msg)
-							fmt.Fprint(w, msg)
-							w.(http.Flusher).Flush()
-							slog.Debug("Sent update", "client_ip", clientIP, "extension", ext, "state", displayState)
-						}
-					}
-				}
-			case <-ticker.C:
-				// Send keep-alive message as a comment (just a colon)
-				msg := ":\n\n"
-				fmt.Fprint(w, msg)
-				w.(http.Flusher).Flush()
-				slog.Debug("Sent keep-alive", "client_ip", clientIP)
-			}
+		// Work out which extensions this client may see
+		scope, err := requestScope(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
 		}
-	})
 
-	// Get server configuration
-	serverIP := os.Getenv("SERVE_IP")
-	serverPort := os.Getenv("SERVE_PORT")
-	if serverIP == "" {
-		serverIP = "127.0.0.1" // Default to localhost
-	}
-	if serverPort == "" {
-		serverPort = "9000" // Default to port 9000
-	}
+		globalBroadcaster.ServeEvents(w, r, clientIP, scope, func() []state.Endpoint {
+			return visibleEndpoints(scope)
+		})
+	})
 
 	// Start server
-	serverAddr := fmt.Sprintf("%s:%s", serverIP, serverPort)
+	serverAddr := net.JoinHostPort(cfg.Server.IP, strconv.Itoa(cfg.Server.Port))
 	log.Printf("Starting server on %s", serverAddr)
-	if err := http.ListenAndServe(serverAddr, sessionManager.LoadAndSave(mux)); err != nil {
+	corsPolicy = NewCORSPolicy(cfg.Server.CORSAllowedOrigins)
+
+	// Reload configuration and descriptions on SIGHUP
+	go handleReloadSignals(opts)
+	if err := http.ListenAndServe(serverAddr, corsPolicy.Middleware(sessionManager.LoadAndSave(csrfProtect(mux)))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"sipblf/state"
+)
+
+// MQTTPublisher mirrors the extension cache to an MQTT broker. Under
+// <topic_prefix>/<server> it publishes:
+//
+//	status                 "online", or "offline" as the last will (retained)
+//	<ext>/state            the state label, e.g. "In use" (retained)
+//	<ext>/attributes       the extension as JSON, as in /api/extensions (retained)
+//	<ext>/transition       each state change as JSON (not retained)
+type MQTTPublisher struct {
+	client mqtt.Client
+	base   string
+	qos    byte
+}
+
+// mqttPublisher is the MQTT publisher, nil when MQTT is disabled
+var mqttPublisher *MQTTPublisher
+
+// NewMQTTPublisher starts connecting to the broker in the background. It
+// keeps retrying and reconnecting, and republishes every extension each
+// time it connects so retained topics catch up on changes missed while
+// disconnected.
+func NewMQTTPublisher(c MQTTConfig) *MQTTPublisher {
+	server := c.Server
+	if server == "" {
+		server, _ = os.Hostname()
+	}
+	clientID := c.ClientID
+	if clientID == "" {
+		clientID = "sipblf-" + server
+	}
+	p := &MQTTPublisher{
+		base: c.TopicPrefix + "/" + server,
+		qos:  byte(c.QoS),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(clientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5*time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.base+"/status", "offline", p.qos, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("Connected to MQTT broker %s", c.Broker)
+			p.publish("status", "online", true)
+			for _, endpoint := range visibleEndpoints(ScopeAll) {
+				p.PublishEndpoint(endpoint)
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Warning: MQTT connection lost: %v", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+	return p
+}
+
+// PublishEndpoint publishes an extension's retained state and attributes
+func (p *MQTTPublisher) PublishEndpoint(endpoint state.Endpoint) {
+	if p == nil || !validTopicLevel(endpoint.Extension) {
+		return
+	}
+	attributes, err := json.Marshal(endpoint)
+	if err != nil {
+		log.Printf("Warning: Failed to encode MQTT attributes for %s: %v", endpoint.Extension, err)
+		return
+	}
+	p.publish(endpoint.Extension+"/state", endpoint.Status.String(), true)
+	p.publish(endpoint.Extension+"/attributes", attributes, true)
+}
+
+// PublishTransition publishes a state change with the extension's new state
+func (p *MQTTPublisher) PublishTransition(t state.Transition, endpoint state.Endpoint) {
+	if p == nil || !validTopicLevel(t.Extension) {
+		return
+	}
+	p.PublishEndpoint(endpoint)
+	payload, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("Warning: Failed to encode MQTT transition for %s: %v", t.Extension, err)
+		return
+	}
+	p.publish(t.Extension+"/transition", payload, false)
+}
+
+// Refresh republishes an extension from the cache, e.g. after its
+// description changes
+func (p *MQTTPublisher) Refresh(ext string) {
+	if p == nil || !isExtension(ext) {
+		return
+	}
+	if endpoint, ok := extensionCache.Snapshot(ext); ok {
+		p.PublishEndpoint(endpoint)
+	}
+}
+
+// Remove clears a removed extension's retained topics
+func (p *MQTTPublisher) Remove(ext string) {
+	if p == nil || !validTopicLevel(ext) {
+		return
+	}
+	p.publish(ext+"/state", "", true)
+	p.publish(ext+"/attributes", "", true)
+}
+
+// publish sends a message without waiting for the broker. While
+// disconnected, messages are dropped; the next connection republishes
+// the retained topics anyway.
+func (p *MQTTPublisher) publish(topic string, payload interface{}, retained bool) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	topic = p.base + "/" + topic
+	token := p.client.Publish(topic, p.qos, retained, payload)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			slog.Debug("MQTT publish failed", "topic", topic, "error", token.Error())
+		}
+	}()
+}
+
+// validTopicLevel reports whether ext can be used as one MQTT topic level
+func validTopicLevel(ext string) bool {
+	if ext == "" || strings.ContainsAny(ext, "/+#") {
+		slog.Debug("Extension is not a valid MQTT topic level", "extension", ext)
+		return false
+	}
+	return true
+}
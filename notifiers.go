@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newNotifier creates a notifier from its configuration
+func newNotifier(c NotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case "webhook":
+		return &WebhookNotifier{name: c.Name, URL: c.URL, Headers: c.Headers, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "smtp":
+		return &SMTPNotifier{name: c.Name, Host: c.Host, Username: c.Username, Password: c.Password, From: c.From, To: c.To}, nil
+	case "syslog":
+		tag := c.Tag
+		if tag == "" {
+			tag = "sipblf"
+		}
+		return &SyslogNotifier{name: c.Name, Network: c.Network, Address: c.Address, Tag: tag}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+	}
+}
+
+// WebhookNotifier POSTs each alert as JSON
+type WebhookNotifier struct {
+	name    string
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// Name identifies the notifier in rules and logs
+func (n *WebhookNotifier) Name() string {
+	return n.name
+}
+
+// Notify posts the alert
+func (n *WebhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier emails each alert
+type SMTPNotifier struct {
+	name     string
+	Host     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Name identifies the notifier in rules and logs
+func (n *SMTPNotifier) Name() string {
+	return n.name
+}
+
+// Notify sends the alert as a plain text email. net/smtp has no context
+// support, so the timeout only applies to the connection.
+func (n *SMTPNotifier) Notify(ctx context.Context, a Alert) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: sipblf alert %s: %s\r\n", a.Status, a.Rule)
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", a.Message)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.Host, auth, n.From, n.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SyslogNotifier writes each alert to syslog, firing alerts as warnings and
+// recoveries as notices
+type SyslogNotifier struct {
+	name    string
+	Network string
+	Address string
+	Tag     string
+
+	mu     sync.Mutex
+	writer *syslog.Writer
+}
+
+// Name identifies the notifier in rules and logs
+func (n *SyslogNotifier) Name() string {
+	return n.name
+}
+
+// Notify logs the alert, connecting on first use
+func (n *SyslogNotifier) Notify(ctx context.Context, a Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.writer == nil {
+		w, err := syslog.Dial(n.Network, n.Address, syslog.LOG_WARNING|syslog.LOG_DAEMON, n.Tag)
+		if err != nil {
+			return err
+		}
+		n.writer = w
+	}
+	var err error
+	if a.Status == "resolved" {
+		err = n.writer.Notice(a.Message)
+	} else {
+		err = n.writer.Warning(a.Message)
+	}
+	if err != nil {
+		// Reconnect next time
+		n.writer.Close()
+		n.writer = nil
+	}
+	return err
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"sipblf/state"
+)
+
+// redisSyncInterval is how often the ingest process rewrites every
+// extension to Redis and web processes re-read them, repairing anything
+// lost while Redis was unreachable
+const redisSyncInterval = time.Minute
+
+// RedisRelay shares extension state between processes. Ingest processes
+// keep a hash of extension snapshots up to date and publish every change
+// on a channel; web processes mirror the hash into their own cache and
+// pass each change on to their own SSE clients.
+type RedisRelay struct {
+	client *redis.Client
+	// key is the hash of extension snapshots, by extension
+	key     string
+	channel string
+	pending chan relayMessage
+}
+
+// relayMessage is one change published on the channel
+type relayMessage struct {
+	// Kind is "update" or "remove"
+	Kind     string         `json:"kind"`
+	Endpoint state.Endpoint `json:"endpoint"`
+}
+
+// redisRelay shares state through Redis, nil when Redis is not configured
+var redisRelay *RedisRelay
+
+// NewRedisRelay connects to Redis. The client reconnects by itself, so an
+// unreachable server is only a warning.
+func NewRedisRelay(c RedisConfig) (*RedisRelay, error) {
+	opts, err := redis.ParseURL(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+	r := &RedisRelay{
+		client:  redis.NewClient(opts),
+		key:     c.Prefix + ":extensions",
+		channel: c.Prefix + ":events",
+		pending: make(chan relayMessage, 1000),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		log.Printf("Warning: Redis is not reachable at %s yet: %v", opts.Addr, err)
+	} else {
+		log.Printf("Connected to Redis at %s", opts.Addr)
+	}
+	return r, nil
+}
+
+// Publish queues an extension's new snapshot for the web processes. It
+// never blocks; if Redis has fallen far behind the change is dropped and
+// the next full sync repairs it.
+func (r *RedisRelay) Publish(endpoint state.Endpoint) {
+	r.queue(relayMessage{Kind: "update", Endpoint: endpoint})
+}
+
+// PublishExtension publishes an extension as it is now in the cache
+func (r *RedisRelay) PublishExtension(ext string) {
+	if r == nil {
+		return
+	}
+	if endpoint, ok := extensionCache.Snapshot(ext); ok {
+		r.Publish(endpoint)
+	}
+}
+
+// Remove tells the web processes an extension no longer exists
+func (r *RedisRelay) Remove(ext string) {
+	r.queue(relayMessage{Kind: "remove", Endpoint: state.Endpoint{Extension: ext}})
+}
+
+func (r *RedisRelay) queue(m relayMessage) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.pending <- m:
+	default:
+		log.Printf("Warning: Redis queue full, change for %s dropped", m.Endpoint.Extension)
+	}
+}
+
+// RunIngest writes queued changes to Redis in order, and rewrites every
+// extension at startup and every redisSyncInterval. Full syncs run in the
+// same goroutine as changes so an older snapshot never overwrites a newer one.
+func (r *RedisRelay) RunIngest() {
+	r.writeAll()
+	ticker := time.NewTicker(redisSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-r.pending:
+			if err := r.write(m); err != nil {
+				log.Printf("Warning: Failed to publish %s to Redis: %v", m.Endpoint.Extension, err)
+			}
+		case <-ticker.C:
+			r.writeAll()
+		}
+	}
+}
+
+func (r *RedisRelay) write(m relayMessage) error {
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if m.Kind == "remove" {
+			p.HDel(ctx, r.key, m.Endpoint.Extension)
+		} else {
+			snapshot, err := json.Marshal(m.Endpoint)
+			if err != nil {
+				return err
+			}
+			p.HSet(ctx, r.key, m.Endpoint.Extension, snapshot)
+		}
+		p.Publish(ctx, r.channel, msg)
+		return nil
+	})
+	return err
+}
+
+// writeAll replaces the hash with every cached extension
+func (r *RedisRelay) writeAll() {
+	endpoints := visibleEndpoints(ScopeAll)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, r.key)
+		for _, endpoint := range endpoints {
+			snapshot, err := json.Marshal(endpoint)
+			if err != nil {
+				return err
+			}
+			p.HSet(ctx, r.key, endpoint.Extension, snapshot)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to sync extensions to Redis: %v", err)
+		return
+	}
+	slog.Debug("Synced extensions to Redis", "extensions", len(endpoints))
+}
+
+// RunWeb follows the ingest process: it subscribes to changes, then
+// re-reads every extension so nothing published before the subscription
+// is missed, and re-reads them again every redisSyncInterval
+func (r *RedisRelay) RunWeb() {
+	ctx := context.Background()
+	sub := r.client.Subscribe(ctx, r.channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		log.Printf("Warning: Failed to subscribe to Redis channel %s, retrying: %v", r.channel, err)
+	}
+	r.Load()
+
+	messages := sub.Channel()
+	ticker := time.NewTicker(redisSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var m relayMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				log.Printf("Warning: Ignoring bad Redis message: %v", err)
+				continue
+			}
+			if m.Kind == "remove" {
+				applyRemoval(m.Endpoint.Extension)
+			} else {
+				applyUpdate(m.Endpoint)
+			}
+		case <-ticker.C:
+			r.Load()
+		}
+	}
+}
+
+// Load brings the cache in line with every extension in Redis, sending
+// connected clients whatever changed
+func (r *RedisRelay) Load() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	all, err := r.client.HGetAll(ctx, r.key).Result()
+	if err != nil {
+		log.Printf("Warning: Failed to read extensions from Redis: %v", err)
+		return
+	}
+	// An empty hash means the ingest process has not synced yet, or Redis
+	// lost its data; keep what we have rather than empty the board
+	if len(all) == 0 {
+		log.Printf("Warning: No extensions in Redis key %s yet", r.key)
+		return
+	}
+
+	for ext, data := range all {
+		var endpoint state.Endpoint
+		if err := json.Unmarshal([]byte(data), &endpoint); err != nil {
+			log.Printf("Warning: Ignoring bad Redis entry for %s: %v", ext, err)
+			continue
+		}
+		applyUpdate(endpoint)
+	}
+	var removed []string
+	for _, ext := range extensionCache.Extensions() {
+		if _, ok := all[ext]; !ok {
+			removed = append(removed, ext)
+		}
+	}
+	for _, ext := range removed {
+		applyRemoval(ext)
+	}
+	slog.Debug("Loaded extensions from Redis", "extensions", len(all), "removed", len(removed))
+}
+
+// applyUpdate stores a snapshot from the ingest process and sends clients
+// the events the ingest process sent its own clients for the same change
+func applyUpdate(endpoint state.Endpoint) {
+	previous, existed := extensionCache.Replace(endpoint)
+	if !existed || previous.Status != endpoint.Status || !previous.Since.Equal(endpoint.Since) {
+		globalBroadcaster.BroadcastFilteredEvent(endpoint.Extension, endpoint.Status)
+		globalBroadcaster.BroadcastTimes(endpoint)
+	}
+	if previous.Description != endpoint.Description || !maps.Equal(previous.Metadata, endpoint.Metadata) {
+		globalBroadcaster.BroadcastDescription(endpoint)
+	}
+	if !slices.Equal(previous.Devices, endpoint.Devices) {
+		globalBroadcaster.BroadcastDevices(endpoint.Extension, endpoint.Devices)
+	}
+}
+
+// applyRemoval drops an extension the ingest process no longer has
+func applyRemoval(ext string) {
+	if extensionCache.Remove(ext) {
+		globalBroadcaster.BroadcastRemoval(ext)
+	}
+}
+
+// ingestOnly answers 501 Not Implemented on web processes for a feature
+// that only the ingest process has, and reports whether it did
+func ingestOnly(w http.ResponseWriter, feature string) bool {
+	if currentConfig().Role != "web" {
+		return false
+	}
+	http.Error(w, feature+" is only available on the ingest process; web processes do not connect to Asterisk", http.StatusNotImplemented)
+	return true
+}
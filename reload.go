@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"sipblf/state"
+)
+
+// reloadMu serialises reloads triggered by SIGHUP and the admin endpoint
+var reloadMu sync.Mutex
+
+// ReloadResult summarises what a reload changed
+type ReloadResult struct {
+	Descriptions state.ListingChanges `json:"descriptions"`
+	Warnings     []string             `json:"warnings,omitempty"`
+}
+
+// reload re-reads the configuration, applies the settings that can change
+// at runtime, and refreshes extension descriptions, pushing any changes to
+// connected clients. Settings that only take effect at startup are reported
+// as warnings. If the new configuration is invalid, nothing is changed.
+func reload(opts *Options) (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newCfg, err := loadConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	oldCfg := currentConfig()
+	result := &ReloadResult{}
+
+	// These are wired up once at startup
+	restartOnly := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server.ip", oldCfg.Server.IP, newCfg.Server.IP},
+		{"server.port", oldCfg.Server.Port, newCfg.Server.Port},
+		{"server.mode", oldCfg.Server.Mode, newCfg.Server.Mode},
+		{"server.cookie_secure", oldCfg.SecureCookie(), newCfg.SecureCookie()},
+		{"session", oldCfg.Session, newCfg.Session},
+		{"tokens", oldCfg.Tokens, newCfg.Tokens},
+		{"ami", oldCfg.AMI, newCfg.AMI},
+		{"history.enabled", oldCfg.History.Enabled, newCfg.History.Enabled},
+		{"history.path", oldCfg.History.Path, newCfg.History.Path},
+		{"history.cleanup_interval", oldCfg.History.CleanupInterval, newCfg.History.CleanupInterval},
+		{"mqtt", oldCfg.MQTT, newCfg.MQTT},
+		{"role", oldCfg.Role, newCfg.Role},
+		{"data_dir", oldCfg.DataDir, newCfg.DataDir},
+		{"redis", oldCfg.Redis, newCfg.Redis},
+	}
+	for _, s := range restartOnly {
+		if !reflect.DeepEqual(s.old, s.new) {
+			result.Warnings = append(result.Warnings, s.name+" changed; restart sipblf to apply")
+		}
+	}
+
+	// Web processes take extensions and descriptions from Redis and do not
+	// alert or call webhooks themselves
+	ingest := oldCfg.Role != "web"
+
+	// Prepare every changed component before applying any, so that one
+	// failing leaves the others as they were
+	var applies []func()
+	if ingest && !reflect.DeepEqual(oldCfg.Directory, newCfg.Directory) {
+		apply, err := directory.Prepare(newCfg.Directory.Sources, amiClient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory configuration: %v", err)
+		}
+		applies = append(applies, apply)
+	}
+
+	if ingest && !reflect.DeepEqual(oldCfg.Alerts, newCfg.Alerts) {
+		apply, err := alerts.Prepare(newCfg.Alerts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alerts configuration: %v", err)
+		}
+		applies = append(applies, apply)
+	}
+
+	if ingest && !reflect.DeepEqual(oldCfg.Webhooks, newCfg.Webhooks) {
+		apply, err := webhooks.Prepare(newCfg.Webhooks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhooks configuration: %v", err)
+		}
+		applies = append(applies, apply)
+	}
+
+	// A changed capture setting overrides the admin switch. It comes last
+	// as preparing it opens the capture file.
+	if ingest && !reflect.DeepEqual(oldCfg.Capture, newCfg.Capture) {
+		apply, err := amiCapture.Prepare(newCfg.Capture)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture configuration: %v", err)
+		}
+		applies = append(applies, apply)
+	}
+
+	if err := setTrustedProxies(newCfg.Server.TrustedProxies); err != nil {
+		return nil, err
+	}
+	appConfig.Store(newCfg)
+	setLogLevel(newCfg.Debug)
+	setExtensionPattern(newCfg.Extensions.Pattern)
+	setPublicPattern(newCfg.Extensions.PublicPattern)
+	loginLimiter.Update(newCfg.Login)
+	corsPolicy.Update(newCfg.Server.CORSAllowedOrigins)
+	for _, apply := range applies {
+		apply()
+	}
+
+	// Branding and the public extensions are rendered into the page, so
+	// ask clients to reload it
+	if newCfg.UI != oldCfg.UI || newCfg.Extensions.PublicPattern != oldCfg.Extensions.PublicPattern {
+		globalBroadcaster.BroadcastEvent("event: reload\ndata: config\n\n")
+	}
+
+	if ingest {
+		result.Descriptions = syncDescriptions()
+	}
+
+	for _, w := range result.Warnings {
+		log.Printf("Warning: Reload: %s", w)
+	}
+	log.Printf("Configuration reloaded, %d descriptions changed", result.Descriptions.Total())
+	return result, nil
+}
+
+// setLogLevel switches between info and debug logging
+func setLogLevel(debug bool) {
+	if debug {
+		logLevel.Set(slog.LevelDebug)
+	} else {
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+// handleReloadSignals reloads on every SIGHUP
+func handleReloadSignals(opts *Options) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("Received SIGHUP, reloading")
+		if _, err := reload(opts); err != nil {
+			log.Printf("Error reloading: %v", err)
+		}
+	}
+}
+
+// registerReloadRoutes adds the admin reload endpoint
+func registerReloadRoutes(mux *http.ServeMux, opts *Options) {
+	mux.HandleFunc("POST /api/admin/reload", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Reload requested", "audit", "reload", "client_ip", clientIP(r))
+		result, err := reload(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+}
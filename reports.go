@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"sipblf/state"
+)
+
+// UsageRow is one extension's usage over one report period
+type UsageRow struct {
+	Start       time.Time `json:"start"`
+	Extension   string    `json:"extension"`
+	Description string    `json:"description,omitempty"`
+	// InUseSeconds is the time spent in use, busy, on hold or ringing while in use
+	InUseSeconds int64 `json:"in_use_seconds"`
+	// Rings counts calls that started ringing, including a call left
+	// ringing on its own when the call it rang alongside ends
+	Rings int `json:"rings"`
+	// UnansweredRings counts rings that stopped without the extension going in use
+	UnansweredRings int `json:"unanswered_rings"`
+}
+
+// UsageTotals is the usage of all extensions over one report period
+type UsageTotals struct {
+	Start           time.Time `json:"start"`
+	InUseSeconds    int64     `json:"in_use_seconds"`
+	Rings           int       `json:"rings"`
+	UnansweredRings int       `json:"unanswered_rings"`
+	// PeakConcurrency is the most extensions in use at the same time
+	PeakConcurrency int `json:"peak_concurrency"`
+}
+
+// UsageReport summarises extension usage per day or week
+type UsageReport struct {
+	Period string        `json:"period"`
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Totals []UsageTotals `json:"totals"`
+	Rows   []UsageRow    `json:"rows"`
+}
+
+// maxReportRange bounds how much history one report reads
+const maxReportRange = 366 * 24 * time.Hour
+
+// inUse reports whether a state counts as the extension being on a call
+func inUse(s state.State) bool {
+	return s == state.InUse || s == state.Busy || s == state.OnHold || s == state.RingInUse
+}
+
+// periodStart returns the start of the day or week (from Monday) containing t, in t's location
+func periodStart(t time.Time, period string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == "week" {
+		offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+		day = day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+// nextPeriod returns the start of the period after the one starting at start
+func nextPeriod(start time.Time, period string) time.Time {
+	if period == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// buildUsageReport computes usage for every extension in scope from the
+// recorded history. Periods start at local midnight (and on Mondays for
+// weeks); from is moved back to the start of its period.
+func buildUsageReport(h *HistoryStore, scope Scope, period string, from, to time.Time) (*UsageReport, error) {
+	from = periodStart(from.Local(), period)
+	to = to.Local()
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	var starts []time.Time
+	for p := from; p.Before(to); p = nextPeriod(p, period) {
+		starts = append(starts, p)
+	}
+	// periodIndex returns the period containing t
+	periodIndex := func(t time.Time) int {
+		return sort.Search(len(starts), func(i int) bool { return starts[i].After(t) }) - 1
+	}
+
+	exts, err := h.Extensions()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{Period: period, From: from, To: to, Rows: []UsageRow{}}
+	totals := make([]UsageTotals, len(starts))
+	for i, start := range starts {
+		totals[i].Start = start
+	}
+
+	// Start and end of every in-use interval, for peak concurrency
+	type edge struct {
+		t     time.Time
+		delta int
+	}
+	var edges []edge
+
+	for _, ext := range exts {
+		if !isExtension(ext) || !scope.CanSee(ext) {
+			continue
+		}
+		before, transitions, err := h.Timeline(ext, from, to)
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]UsageRow, len(starts))
+		// In-use time per period, only truncated to seconds once summed
+		inUseTime := make([]time.Duration, len(starts))
+
+		current, since := state.Unknown, from
+		if before != nil {
+			current = before.To
+		}
+		// addInterval credits in-use time in [a, b) to the periods it spans
+		addInterval := func(a, b time.Time) {
+			if !inUse(current) || !a.Before(b) {
+				return
+			}
+			edges = append(edges, edge{a, 1}, edge{b, -1})
+			for i := periodIndex(a); i < len(starts) && starts[i].Before(b); i++ {
+				end := b
+				if i+1 < len(starts) && starts[i+1].Before(end) {
+					end = starts[i+1]
+				}
+				begin := a
+				if starts[i].After(begin) {
+					begin = starts[i]
+				}
+				inUseTime[i] += end.Sub(begin)
+			}
+		}
+
+		// Start of the current ring on an idle extension, zero if it is not
+		// ringing or the ring began before the range
+		var ringStart time.Time
+		for _, t := range transitions {
+			addInterval(since, t.Time)
+			i := periodIndex(t.Time)
+			// A ring on an idle extension is answered if it goes in use
+			if t.From == state.Ringing {
+				if !inUse(t.To) && !ringStart.IsZero() {
+					if j := periodIndex(ringStart); j >= 0 {
+						rows[j].UnansweredRings++
+					}
+				}
+				ringStart = time.Time{}
+			}
+			if t.To == state.Ringing || t.To == state.RingInUse {
+				wasRinging := t.From == state.Ringing || t.From == state.RingInUse
+				if (!wasRinging || t.To == state.Ringing) && i >= 0 {
+					rows[i].Rings++
+				}
+				if t.To == state.Ringing {
+					ringStart = t.Time
+				}
+			}
+			current, since = t.To, t.Time
+		}
+		addInterval(since, to)
+		for i, d := range inUseTime {
+			rows[i].InUseSeconds = int64(d.Seconds())
+		}
+
+		description := ""
+		if endpoint, ok := extensionCache.Snapshot(ext); ok {
+			description = endpoint.Description
+		}
+
+		for i, row := range rows {
+			if row.InUseSeconds == 0 && row.Rings == 0 && row.UnansweredRings == 0 {
+				continue
+			}
+			row.Start = starts[i]
+			row.Extension = ext
+			row.Description = description
+			report.Rows = append(report.Rows, row)
+			totals[i].InUseSeconds += row.InUseSeconds
+			totals[i].Rings += row.Rings
+			totals[i].UnansweredRings += row.UnansweredRings
+		}
+	}
+
+	// Sweep the in-use intervals in time order; at equal times ends come
+	// first so back-to-back calls do not count as concurrent
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].t.Equal(edges[j].t) {
+			return edges[i].delta < edges[j].delta
+		}
+		return edges[i].t.Before(edges[j].t)
+	})
+	active, next := 0, 0
+	for i, start := range starts {
+		for next < len(edges) && edges[next].t.Before(start) {
+			active += edges[next].delta
+			next++
+		}
+		peak := active
+		end := to
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		for next < len(edges) && edges[next].t.Before(end) {
+			active += edges[next].delta
+			peak = max(peak, active)
+			next++
+		}
+		totals[i].PeakConcurrency = peak
+	}
+	report.Totals = totals
+
+	sort.Slice(report.Rows, func(i, j int) bool {
+		if !report.Rows[i].Start.Equal(report.Rows[j].Start) {
+			return report.Rows[i].Start.Before(report.Rows[j].Start)
+		}
+		return naturalLess(report.Rows[i].Extension, report.Rows[j].Extension)
+	})
+	return report, nil
+}
+
+// writeUsageCSV writes the report as CSV, one row per extension per period
+// followed by an "ALL" row per period with the totals
+func writeUsageCSV(w http.ResponseWriter, report *UsageReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sipblf-usage-%s-%s.csv"`, report.Period, report.From.Format("2006-01-02")))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"period_start", "extension", "description", "in_use_seconds", "rings", "unanswered_rings", "peak_concurrency"})
+	for _, row := range report.Rows {
+		cw.Write([]string{
+			row.Start.Format("2006-01-02"),
+			row.Extension,
+			row.Description,
+			strconv.FormatInt(row.InUseSeconds, 10),
+			strconv.Itoa(row.Rings),
+			strconv.Itoa(row.UnansweredRings),
+			"",
+		})
+	}
+	for _, t := range report.Totals {
+		cw.Write([]string{
+			t.Start.Format("2006-01-02"),
+			"ALL",
+			"",
+			strconv.FormatInt(t.InUseSeconds, 10),
+			strconv.Itoa(t.Rings),
+			strconv.Itoa(t.UnansweredRings),
+			strconv.Itoa(t.PeakConcurrency),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Debug("Failed to write CSV response", "error", err)
+	}
+}
+
+// registerReportRoutes adds the usage report API
+func registerReportRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/reports/usage", func(w http.ResponseWriter, r *http.Request) {
+		// Reports are for logged-in users and all-scope tokens only
+		scope, err := requestScope(r)
+		if err != nil || scope != ScopeAll {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ingestOnly(w, "Reports") {
+			return
+		}
+		if history == nil {
+			http.Error(w, "History is disabled", http.StatusNotFound)
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "day"
+		}
+		if period != "day" && period != "week" {
+			http.Error(w, "period must be day or week", http.StatusBadRequest)
+			return
+		}
+		defaultSpan := 7 * 24 * time.Hour
+		if period == "week" {
+			defaultSpan = 4 * 7 * 24 * time.Hour
+		}
+		from, to, err := parseTimeRange(r, defaultSpan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to.Sub(from) > maxReportRange {
+			http.Error(w, "range must not exceed 366 days", http.StatusBadRequest)
+			return
+		}
+
+		report, err := buildUsageReport(history, scope, period, from, to)
+		if err != nil {
+			slog.Error("Failed to build usage report", "error", err)
+			http.Error(w, "Failed to build report", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "csv" {
+			writeUsageCSV(w, report)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"sipblf/state"
+)
+
+// reportDay is the first day of the test reports, in local time as
+// reports use
+var reportDay = time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+
+// clock returns a time on day d of the report, e.g. clock(0, "10:00:05.5")
+func clock(d int, hms string) time.Time {
+	t, err := time.Parse("15:04:05.999", hms)
+	if err != nil {
+		panic(err)
+	}
+	return reportDay.AddDate(0, 0, d).Add(t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)))
+}
+
+// calls builds the transitions of one extension passing through states
+// at the given times
+func calls(ext string, steps ...interface{}) []state.Transition {
+	var ts []state.Transition
+	from := state.NotInUse
+	for i := 0; i < len(steps); i += 2 {
+		to := steps[i+1].(state.State)
+		ts = append(ts, state.Transition{Time: steps[i].(time.Time), Extension: ext, From: from, To: to})
+		from = to
+	}
+	return ts
+}
+
+func TestBuildUsageReport(t *testing.T) {
+	type row struct {
+		day        int
+		inUse      int64
+		rings      int
+		unanswered int
+	}
+	tests := []struct {
+		name        string
+		transitions []state.Transition
+		want        []row
+	}{
+		{
+			name: "call across midnight",
+			transitions: calls("100",
+				clock(0, "23:00:00"), state.InUse,
+				clock(1, "01:00:00"), state.NotInUse),
+			want: []row{{day: 0, inUse: 3600}, {day: 1, inUse: 3600}},
+		},
+		{
+			name: "in use from before the range",
+			transitions: calls("100",
+				clock(-1, "23:30:00"), state.InUse,
+				clock(0, "00:30:00"), state.NotInUse),
+			want: []row{{day: 0, inUse: 1800}},
+		},
+		{
+			name: "in use at the end of the range",
+			transitions: calls("100",
+				clock(1, "23:00:00"), state.InUse),
+			want: []row{{day: 1, inUse: 3600}},
+		},
+		{
+			name: "fractions of seconds add up",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.InUse,
+				clock(0, "10:00:01.5"), state.NotInUse,
+				clock(0, "10:01:00"), state.OnHold,
+				clock(0, "10:01:01.5"), state.NotInUse,
+				clock(0, "10:02:00"), state.Busy,
+				clock(0, "10:02:01.5"), state.NotInUse),
+			want: []row{{day: 0, inUse: 4}},
+		},
+		{
+			name: "ringing then idle is unanswered",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.Ringing,
+				clock(0, "10:00:20"), state.NotInUse),
+			want: []row{{day: 0, rings: 1, unanswered: 1}},
+		},
+		{
+			name: "ringing then unavailable is unanswered",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.Ringing,
+				clock(0, "10:00:20"), state.Unavailable),
+			want: []row{{day: 0, rings: 1, unanswered: 1}},
+		},
+		{
+			name: "ringing then in use is answered",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.Ringing,
+				clock(0, "10:00:05"), state.InUse,
+				clock(0, "10:01:05"), state.NotInUse),
+			want: []row{{day: 0, inUse: 60, rings: 1}},
+		},
+		{
+			name: "answered on another device while one rings on",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.Ringing,
+				clock(0, "10:00:05"), state.RingInUse,
+				clock(0, "10:00:07"), state.InUse,
+				clock(0, "10:01:05"), state.NotInUse),
+			want: []row{{day: 0, inUse: 60, rings: 1}},
+		},
+		{
+			name: "call waiting rings on after the call ends",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.InUse,
+				clock(0, "10:01:00"), state.RingInUse,
+				clock(0, "10:02:00"), state.Ringing,
+				clock(0, "10:02:30"), state.NotInUse),
+			want: []row{{day: 0, inUse: 120, rings: 2, unanswered: 1}},
+		},
+		{
+			name: "answered ring is not counted again",
+			transitions: calls("100",
+				clock(0, "10:00:00"), state.Ringing,
+				clock(0, "10:00:05"), state.InUse,
+				clock(0, "10:01:05"), state.OnHold,
+				clock(0, "10:01:10"), state.NotInUse,
+				clock(0, "10:05:00"), state.Unavailable),
+			want: []row{{day: 0, inUse: 65, rings: 1}},
+		},
+		{
+			name: "unanswered ring counts on the day it started",
+			transitions: calls("100",
+				clock(0, "23:59:50"), state.Ringing,
+				clock(1, "00:00:10"), state.NotInUse),
+			want: []row{{day: 0, rings: 1, unanswered: 1}},
+		},
+		{
+			name: "ring from before the range",
+			transitions: calls("100",
+				clock(-1, "23:59:50"), state.Ringing,
+				clock(0, "00:00:10"), state.NotInUse),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHistory(t, 1)
+			if err := h.write(tt.transitions); err != nil {
+				t.Fatal(err)
+			}
+			report, err := buildUsageReport(h, ScopeAll, "day", reportDay, reportDay.AddDate(0, 0, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []row
+			for _, r := range report.Rows {
+				got = append(got, row{
+					day:        int(r.Start.Sub(reportDay) / (24 * time.Hour)),
+					inUse:      r.InUseSeconds,
+					rings:      r.Rings,
+					unanswered: r.UnansweredRings,
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows %+v, want %+v", got, tt.want)
+			}
+			// Totals add up the rows of one extension
+			for _, w := range tt.want {
+				total := report.Totals[w.day]
+				if total.InUseSeconds != w.inUse || total.Rings != w.rings || total.UnansweredRings != w.unanswered {
+					t.Errorf("day %d totals %+v, want %+v", w.day, total, w)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageReportPeakConcurrency(t *testing.T) {
+	h := testHistory(t, 1)
+	var transitions []state.Transition
+	for _, c := range [][]state.Transition{
+		calls("100", clock(0, "10:00:00"), state.InUse, clock(0, "10:30:00"), state.NotInUse),
+		calls("101", clock(0, "10:15:00"), state.InUse, clock(0, "10:45:00"), state.NotInUse),
+		// Starts as 100 ends, so is not concurrent with it
+		calls("102", clock(0, "10:30:00"), state.InUse, clock(0, "11:00:00"), state.NotInUse),
+		calls("103", clock(0, "10:20:00"), state.OnHold, clock(0, "10:25:00"), state.NotInUse),
+		// Across midnight, overlapping 105 on the second day only
+		calls("104", clock(0, "23:00:00"), state.InUse, clock(1, "00:30:00"), state.NotInUse),
+		calls("105", clock(1, "00:10:00"), state.Busy, clock(1, "00:20:00"), state.NotInUse),
+		// Changes between in-use states do not end the call
+		calls("106", clock(1, "12:00:00"), state.InUse, clock(1, "12:05:00"), state.OnHold, clock(1, "12:10:00"), state.NotInUse),
+	} {
+		transitions = append(transitions, c...)
+	}
+	if err := h.write(transitions); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := buildUsageReport(h, ScopeAll, "day", reportDay, reportDay.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, total := range report.Totals {
+		got = append(got, total.PeakConcurrency)
+	}
+	if want := []int{3, 2, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peak concurrency per day %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexedwards/scs/mysqlstore"
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/go-sql-driver/mysql"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newSessionStore creates the configured session store: "memory" (sessions
+// are lost on restart), "bolt" (a local file) or "mysql" (the sessions table
+// in the database given by the session DSN). Expired sessions are removed
+// every cleanup interval.
+func newSessionStore(c SessionConfig) (scs.Store, error) {
+	cleanup := c.CleanupInterval
+
+	switch c.Store {
+	case "memory":
+		return memstore.NewWithCleanupInterval(cleanup), nil
+
+	case "bolt":
+		db, err := bolt.Open(c.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session file %s: %v", c.Path, err)
+		}
+		return NewBoltStore(db, cleanup)
+
+	case "mysql":
+		dsn, err := mysql.ParseDSN(c.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session DSN: %v", err)
+		}
+		dsn.ParseTime = true
+		db, err := sql.Open("mysql", dsn.FormatDSN())
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to session database: %v", err)
+		}
+		if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+			token CHAR(43) PRIMARY KEY,
+			data BLOB NOT NULL,
+			expiry TIMESTAMP(6) NOT NULL,
+			INDEX sessions_expiry_idx (expiry)
+		)`); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create sessions table: %v", err)
+		}
+		return mysqlstore.NewWithCleanupInterval(db, cleanup), nil
+
+	default:
+		return nil, fmt.Errorf("unknown session store %q (want memory, bolt or mysql)", c.Store)
+	}
+}
+
+// BoltStore is an scs.Store that keeps sessions in a BoltDB file. Each value
+// is an 8-byte big-endian expiry (Unix nanoseconds) followed by the session data.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var sessionsBucket = []byte("sessions")
+
+// NewBoltStore creates a BoltDB-backed session store, removing expired
+// sessions every cleanupInterval. An interval of 0 disables cleanup.
+func NewBoltStore(db *bolt.DB, cleanupInterval time.Duration) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sessions bucket: %v", err)
+	}
+
+	b := &BoltStore{db: db}
+	if cleanupInterval > 0 {
+		go b.startCleanup(cleanupInterval)
+	}
+	return b, nil
+}
+
+// Find returns the data for a session token, if it exists and has not expired
+func (b *BoltStore) Find(token string) ([]byte, bool, error) {
+	var data []byte
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(token))
+		if len(v) < 8 || time.Now().UnixNano() >= int64(binary.BigEndian.Uint64(v)) {
+			return nil
+		}
+		data, found = append([]byte{}, v[8:]...), true
+		return nil
+	})
+	return data, found, err
+}
+
+// Commit adds or replaces a session token
+func (b *BoltStore) Commit(token string, data []byte, expiry time.Time) error {
+	v := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(v, uint64(expiry.UnixNano()))
+	copy(v[8:], data)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(token), v)
+	})
+}
+
+// Delete removes a session token
+func (b *BoltStore) Delete(token string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(token))
+	})
+}
+
+func (b *BoltStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := b.deleteExpired(); err != nil {
+			log.Printf("Warning: Failed to remove expired sessions: %v", err)
+		}
+	}
+}
+
+func (b *BoltStore) deleteExpired() error {
+	now := time.Now().UnixNano()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		// Collect keys first; deleting while iterating a cursor can skip entries
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || now >= int64(binary.BigEndian.Uint64(v)) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBoltStore(t *testing.T) (*BoltStore, *bolt.DB) {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "sessions.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := NewBoltStore(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, db
+}
+
+func TestBoltStore(t *testing.T) {
+	store, _ := openTestBoltStore(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		token  string
+		data   []byte
+		expiry time.Time
+		want   bool
+	}{
+		{"live session", "live", []byte("data"), now.Add(time.Hour), true},
+		{"empty data", "empty", []byte{}, now.Add(time.Hour), true},
+		{"expired session", "expired", []byte("old"), now.Add(-time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.Commit(tt.token, tt.data, tt.expiry); err != nil {
+				t.Fatal(err)
+			}
+			data, found, err := store.Find(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.want {
+				t.Fatalf("found = %v, want %v", found, tt.want)
+			}
+			if found && !bytes.Equal(data, tt.data) {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+		})
+	}
+
+	if _, found, _ := store.Find("missing"); found {
+		t.Error("found a token that was never committed")
+	}
+
+	// Commit replaces the data and expiry
+	store.Commit("live", []byte("new"), now.Add(2*time.Hour))
+	if data, _, _ := store.Find("live"); string(data) != "new" {
+		t.Errorf("data after recommit = %q, want new", data)
+	}
+
+	if err := store.Delete("live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Find("live"); found {
+		t.Error("found a deleted token")
+	}
+}
+
+func TestBoltStoreDeleteExpired(t *testing.T) {
+	store, db := openTestBoltStore(t)
+	now := time.Now()
+	store.Commit("live", []byte("a"), now.Add(time.Hour))
+	store.Commit("expired1", []byte("b"), now.Add(-time.Hour))
+	store.Commit("expired2", []byte("c"), now.Add(-time.Millisecond))
+	// A truncated value cannot be read and is removed too
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte("corrupt"), []byte{1, 2})
+	})
+
+	if err := store.deleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "live" {
+		t.Errorf("sessions after cleanup = %v, want [live]", keys)
+	}
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	store, err := newSessionStore(SessionConfig{Store: "bolt", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Commit("token", []byte("data"), time.Now().Add(time.Hour))
+	store.(*BoltStore).db.Close()
+
+	store, err = newSessionStore(SessionConfig{Store: "bolt", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*BoltStore).db.Close()
+	if data, found, _ := store.Find("token"); !found || string(data) != "data" {
+		t.Errorf("after reopening: %q, %v", data, found)
+	}
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Endpoint is a phone extension and its combined state
+type Endpoint struct {
+	Extension   string
+	Description string
+	Status      State
+	Disabled    bool
+	// Metadata holds extra directory fields such as department, site or email
+	Metadata map[string]string `json:",omitempty"`
+	// Devices is the state of each device rolled up into this extension,
+	// only given to authenticated clients
+	Devices []DeviceState `json:",omitempty"`
+	// Since is when the extension entered its current state
+	Since time.Time `json:",omitzero"`
+	// LastSeen is when the extension was last reachable
+	LastSeen time.Time `json:",omitzero"`
+	// devices holds the state of each device, keyed by device name
+	devices map[string]State
+}
+
+// DeviceState is the state of one device belonging to an extension
+type DeviceState struct {
+	Device string
+	Status State
+}
+
+// Transition is one change of an extension's combined state
+type Transition struct {
+	Time      time.Time `json:"time"`
+	Extension string    `json:"extension"`
+	// Device is the device whose change caused the transition, if known
+	Device string `json:"device,omitempty"`
+	From   State  `json:"from"`
+	To     State  `json:"to"`
+}
+
+// statePrecedence lists states from most to least significant. An
+// extension with several devices (desk phone, softphone, mobile app) shows
+// the first of these that any of its devices is in:
+//
+//	ringing > in use (or busy) > on hold > idle > unavailable
+//
+// so a call ringing on any device shows as ringing, and the extension is
+// only unavailable when none of its devices is reachable. As in Asterisk's
+// own hint aggregation, one device ringing while another is in use or on
+// hold shows as ringing (in use).
+var statePrecedence = []State{
+	RingInUse,
+	Ringing,
+	InUse,
+	Busy,
+	OnHold,
+	NotInUse,
+	Unavailable,
+	Invalid,
+	Unknown,
+}
+
+// stateRank returns a state's position in statePrecedence, lower is more significant
+func stateRank(state State) int {
+	if i := slices.Index(statePrecedence, state); i >= 0 {
+		return i
+	}
+	return len(statePrecedence)
+}
+
+// combinedState returns the state of an extension from its devices' states
+func combinedState(devices map[string]State) State {
+	if len(devices) == 0 {
+		return Unavailable
+	}
+	var ringing, busy bool
+	combined := Unknown
+	for _, state := range devices {
+		switch state {
+		case Ringing:
+			ringing = true
+		case InUse, Busy, OnHold, RingInUse:
+			busy = true
+		}
+		if stateRank(state) < stateRank(combined) {
+			combined = state
+		}
+	}
+	if ringing && busy {
+		return RingInUse
+	}
+	return combined
+}
+
+// deviceStates returns the per-device detail of an endpoint, sorted by device.
+// The caller must hold the cache lock.
+func (e *Endpoint) deviceStates() []DeviceState {
+	devices := make([]DeviceState, 0, len(e.devices))
+	for device, state := range e.devices {
+		devices = append(devices, DeviceState{Device: device, Status: state})
+	}
+	slices.SortFunc(devices, func(a, b DeviceState) int {
+		return strings.Compare(a.Device, b.Device)
+	})
+	return devices
+}
+
+// snapshot returns a copy of the endpoint that is safe to use without the
+// cache lock, with per-device detail only if withDevices is set. The caller
+// must hold the cache lock.
+func (e *Endpoint) snapshot(withDevices bool) Endpoint {
+	s := *e
+	s.devices = nil
+	s.Devices = nil
+	if withDevices {
+		s.Devices = e.deviceStates()
+	}
+	// A reachable extension is being seen right now
+	if s.Status.Reachable() {
+		s.LastSeen = time.Now()
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package state
+
+import "testing"
+
+func TestCombinedState(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices map[string]State
+		want    State
+	}{
+		{"no devices", nil, Unavailable},
+		{"one idle", map[string]State{"PJSIP/101": NotInUse}, NotInUse},
+		{"ringing beats idle", map[string]State{"PJSIP/101": NotInUse, "PJSIP/101-soft": Ringing}, Ringing},
+		{"in use beats on hold", map[string]State{"PJSIP/101": OnHold, "PJSIP/101-soft": InUse}, InUse},
+		{"busy beats on hold", map[string]State{"PJSIP/101": OnHold, "PJSIP/101-soft": Busy}, Busy},
+		{"on hold beats idle", map[string]State{"PJSIP/101": NotInUse, "PJSIP/101-soft": OnHold}, OnHold},
+		{"idle beats unavailable", map[string]State{"PJSIP/101": Unavailable, "PJSIP/101-soft": NotInUse}, NotInUse},
+		{"unavailable beats invalid", map[string]State{"PJSIP/101": Invalid, "PJSIP/101-soft": Unavailable}, Unavailable},
+		{"invalid beats unknown", map[string]State{"PJSIP/101": Unknown, "PJSIP/101-soft": Invalid}, Invalid},
+		{"ringing and in use", map[string]State{"PJSIP/101": InUse, "PJSIP/101-soft": Ringing}, RingInUse},
+		{"ringing and on hold", map[string]State{"PJSIP/101": OnHold, "PJSIP/101-soft": Ringing}, RingInUse},
+		{"ringing and unavailable", map[string]State{"PJSIP/101": Unavailable, "PJSIP/101-soft": Ringing}, Ringing},
+		{"ring in use alone", map[string]State{"PJSIP/101": RingInUse}, RingInUse},
+		{"all unreachable", map[string]State{"PJSIP/101": Unavailable, "PJSIP/101-soft": Unavailable}, Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combinedState(tt.devices); got != tt.want {
+				t.Errorf("combinedState(%v) = %s, want %s", tt.devices, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   State
+		wantOK bool
+	}{
+		{"NOT_INUSE", NotInUse, true},
+		{"not_inuse", NotInUse, true},
+		{"Not in use", NotInUse, true},
+		{"IDLE", NotInUse, true},
+		{" RINGINUSE ", RingInUse, true},
+		{"ONHOLD", OnHold, true},
+		{"UNKNOWN", Unknown, true},
+		{"SLEEPING", Unknown, false},
+		{"", Unknown, false},
+	}
+	for _, tt := range tests {
+		got, ok := Lookup(tt.in)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Lookup(%q) = %s, %v, want %s, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
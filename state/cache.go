@@ -0,0 +1,187 @@
+package state
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Cache holds the current state of every extension. It is safe for
+// concurrent use; everything it returns is a copy.
+type Cache struct {
+	mu     sync.RWMutex
+	states map[string]*Endpoint
+}
+
+// NewCache returns an empty cache
+func NewCache() *Cache {
+	return &Cache{states: make(map[string]*Endpoint)}
+}
+
+// UpdateDevice records the state of one of an extension's devices. It
+// returns the extension's combined state before the update and a snapshot
+// of the extension, including per-device detail, after it.
+func (c *Cache) UpdateDevice(ext, device string, state State) (previous State, endpoint Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, exists := c.states[ext]
+	if !exists {
+		// Start from unknown so the first report is always a change
+		e = &Endpoint{Extension: ext, Status: Unknown}
+		c.states[ext] = e
+	}
+	if e.devices == nil {
+		e.devices = make(map[string]State)
+	}
+	e.devices[device] = state
+	previous = e.Status
+	e.Status = combinedState(e.devices)
+
+	now := time.Now()
+	if e.Status != previous || e.Since.IsZero() {
+		e.Since = now
+	}
+	if previous.Reachable() || e.Status.Reachable() {
+		e.LastSeen = now
+	}
+	return previous, e.snapshot(true)
+}
+
+// Snapshot returns a copy of an extension, including per-device detail
+func (c *Cache) Snapshot(ext string) (Endpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.states[ext]
+	if !ok {
+		return Endpoint{}, false
+	}
+	return e.snapshot(true), true
+}
+
+// Replace stores an extension, such as a snapshot taken by another
+// process, rebuilding its per-device states from Devices. It returns the
+// snapshot it replaced, if any.
+func (c *Cache) Replace(endpoint Endpoint) (previous Endpoint, existed bool) {
+	e := endpoint
+	e.devices = make(map[string]State, len(endpoint.Devices))
+	for _, d := range endpoint.Devices {
+		e.devices[d.Device] = d.Status
+	}
+	e.Devices = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.states[endpoint.Extension]; ok {
+		previous, existed = old.snapshot(true), true
+	}
+	c.states[endpoint.Extension] = &e
+	return previous, existed
+}
+
+// Remove drops an extension, reporting whether it was cached
+func (c *Cache) Remove(ext string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.states[ext]
+	delete(c.states, ext)
+	return ok
+}
+
+// List returns a snapshot of every extension that visible accepts, in no
+// particular order, with per-device detail only if withDevices is set
+func (c *Cache) List(visible func(ext string) bool, withDevices bool) []Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	endpoints := []Endpoint{}
+	for ext, e := range c.states {
+		if visible(ext) {
+			endpoints = append(endpoints, e.snapshot(withDevices))
+		}
+	}
+	return endpoints
+}
+
+// Extensions returns every cached extension, in no particular order
+func (c *Cache) Extensions() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	exts := make([]string, 0, len(c.states))
+	for ext := range c.states {
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// Listing is what a directory knows about an extension
+type Listing struct {
+	Description string
+	Metadata    map[string]string
+}
+
+// ListingChanges counts what applying a directory changed
+type ListingChanges struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Renamed int `json:"renamed"`
+	Updated int `json:"updated"`
+}
+
+// Total returns the number of changed endpoints
+func (c ListingChanges) Total() int {
+	return c.Added + c.Removed + c.Renamed + c.Updated
+}
+
+// ApplyListings brings descriptions and metadata in line with a directory.
+// Extensions new to the directory are added as unavailable; extensions
+// removed from it are dropped if they are unavailable, otherwise they just
+// lose their description. Metadata-only changes are counted as updates. It
+// returns snapshots of the changed and removed extensions.
+func (c *Cache) ApplyListings(listings map[string]Listing) (changes ListingChanges, changed, removed []Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ext, listing := range listings {
+		if e, exists := c.states[ext]; exists {
+			switch {
+			case e.Description != listing.Description:
+				if e.Description == "" {
+					changes.Added++
+				} else {
+					changes.Renamed++
+				}
+			case !maps.Equal(e.Metadata, listing.Metadata):
+				changes.Updated++
+			default:
+				continue
+			}
+			e.Description = listing.Description
+			e.Metadata = listing.Metadata
+			changed = append(changed, e.snapshot(true))
+		} else {
+			changes.Added++
+			e := &Endpoint{
+				Extension:   ext,
+				Description: listing.Description,
+				Metadata:    listing.Metadata,
+				Status:      Unavailable,
+			}
+			c.states[ext] = e
+			changed = append(changed, e.snapshot(true))
+		}
+	}
+	for ext, e := range c.states {
+		if _, exists := listings[ext]; exists || (e.Description == "" && len(e.Metadata) == 0) {
+			continue
+		}
+		changes.Removed++
+		if !e.Status.Reachable() {
+			delete(c.states, ext)
+			removed = append(removed, e.snapshot(true))
+		} else {
+			e.Description = ""
+			e.Metadata = nil
+			changed = append(changed, e.snapshot(true))
+		}
+	}
+	return changes, changed, removed
+}
@@ -0,0 +1,211 @@
+package state
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestCacheUpdateDevice(t *testing.T) {
+	type step struct {
+		device       string
+		state        State
+		wantPrevious State
+		wantStatus   State
+		wantDevices  int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first report is a change from unknown", []step{
+			{"PJSIP/101", NotInUse, Unknown, NotInUse, 1},
+		}},
+		{"single device changes", []step{
+			{"PJSIP/101", NotInUse, Unknown, NotInUse, 1},
+			{"PJSIP/101", Ringing, NotInUse, Ringing, 1},
+			{"PJSIP/101", InUse, Ringing, InUse, 1},
+			{"PJSIP/101", NotInUse, InUse, NotInUse, 1},
+		}},
+		{"devices roll up", []step{
+			{"PJSIP/101", InUse, Unknown, InUse, 1},
+			{"PJSIP/101-soft", Ringing, InUse, RingInUse, 2},
+			{"PJSIP/101-soft", NotInUse, RingInUse, InUse, 2},
+			{"PJSIP/101", NotInUse, InUse, NotInUse, 2},
+		}},
+		{"unavailable only when every device is", []step{
+			{"PJSIP/101", Unavailable, Unknown, Unavailable, 1},
+			{"PJSIP/101-soft", NotInUse, Unavailable, NotInUse, 2},
+			{"PJSIP/101-soft", Unavailable, NotInUse, Unavailable, 2},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache()
+			for i, s := range tt.steps {
+				previous, endpoint := c.UpdateDevice("101", s.device, s.state)
+				if previous != s.wantPrevious {
+					t.Errorf("step %d: previous = %s, want %s", i, previous, s.wantPrevious)
+				}
+				if endpoint.Status != s.wantStatus {
+					t.Errorf("step %d: status = %s, want %s", i, endpoint.Status, s.wantStatus)
+				}
+				if len(endpoint.Devices) != s.wantDevices {
+					t.Errorf("step %d: %d devices, want %d", i, len(endpoint.Devices), s.wantDevices)
+				}
+				if endpoint.Since.IsZero() {
+					t.Errorf("step %d: Since not set", i)
+				}
+				if got, _ := c.Snapshot("101"); got.Status != s.wantStatus {
+					t.Errorf("step %d: cached status = %s, want %s", i, got.Status, s.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheUpdateDeviceKeepsSince(t *testing.T) {
+	c := NewCache()
+	_, first := c.UpdateDevice("101", "PJSIP/101", InUse)
+	// Another device changing without changing the combined state
+	_, second := c.UpdateDevice("101", "PJSIP/101-soft", OnHold)
+	if second.Status != InUse {
+		t.Fatalf("status = %s, want %s", second.Status, InUse)
+	}
+	if !second.Since.Equal(first.Since) {
+		t.Errorf("Since moved from %v to %v without a state change", first.Since, second.Since)
+	}
+}
+
+func TestCacheApplyListings(t *testing.T) {
+	// cached sets up the cache before the listings are applied
+	type cached struct {
+		ext, description string
+		metadata         map[string]string
+		state            State
+	}
+	tests := []struct {
+		name        string
+		cached      []cached
+		listings    map[string]Listing
+		want        ListingChanges
+		wantChanged []string
+		wantRemoved []string
+		// wantCache maps each extension left in the cache to its description
+		wantCache map[string]string
+	}{
+		{
+			name:        "new extension is added as unavailable",
+			listings:    map[string]Listing{"101": {Description: "Reception"}},
+			want:        ListingChanges{Added: 1},
+			wantChanged: []string{"101"},
+			wantCache:   map[string]string{"101": "Reception"},
+		},
+		{
+			name:        "first description counts as added",
+			cached:      []cached{{ext: "101", state: NotInUse}},
+			listings:    map[string]Listing{"101": {Description: "Reception"}},
+			want:        ListingChanges{Added: 1},
+			wantChanged: []string{"101"},
+			wantCache:   map[string]string{"101": "Reception"},
+		},
+		{
+			name:        "renamed",
+			cached:      []cached{{ext: "101", description: "Reception", state: NotInUse}},
+			listings:    map[string]Listing{"101": {Description: "Front desk"}},
+			want:        ListingChanges{Renamed: 1},
+			wantChanged: []string{"101"},
+			wantCache:   map[string]string{"101": "Front desk"},
+		},
+		{
+			name:        "metadata only is an update",
+			cached:      []cached{{ext: "101", description: "Reception", state: NotInUse}},
+			listings:    map[string]Listing{"101": {Description: "Reception", Metadata: map[string]string{"site": "HQ"}}},
+			want:        ListingChanges{Updated: 1},
+			wantChanged: []string{"101"},
+			wantCache:   map[string]string{"101": "Reception"},
+		},
+		{
+			name:      "unchanged",
+			cached:    []cached{{ext: "101", description: "Reception", metadata: map[string]string{"site": "HQ"}, state: NotInUse}},
+			listings:  map[string]Listing{"101": {Description: "Reception", Metadata: map[string]string{"site": "HQ"}}},
+			wantCache: map[string]string{"101": "Reception"},
+		},
+		{
+			name:        "removed and unavailable is dropped",
+			cached:      []cached{{ext: "101", description: "Reception", state: Unavailable}},
+			listings:    map[string]Listing{},
+			want:        ListingChanges{Removed: 1},
+			wantRemoved: []string{"101"},
+			wantCache:   map[string]string{},
+		},
+		{
+			name:        "removed but reachable loses its description",
+			cached:      []cached{{ext: "101", description: "Reception", state: InUse}},
+			listings:    map[string]Listing{},
+			want:        ListingChanges{Removed: 1},
+			wantChanged: []string{"101"},
+			wantCache:   map[string]string{"101": ""},
+		},
+		{
+			name:      "never listed is left alone",
+			cached:    []cached{{ext: "101", state: NotInUse}},
+			listings:  map[string]Listing{},
+			wantCache: map[string]string{"101": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache()
+			for _, e := range tt.cached {
+				c.Replace(Endpoint{
+					Extension:   e.ext,
+					Description: e.description,
+					Metadata:    e.metadata,
+					Status:      e.state,
+					Devices:     []DeviceState{{Device: "PJSIP/" + e.ext, Status: e.state}},
+				})
+			}
+
+			changes, changed, removed := c.ApplyListings(tt.listings)
+			if changes != tt.want {
+				t.Errorf("changes = %+v, want %+v", changes, tt.want)
+			}
+			if got := extensions(changed); !slices.Equal(got, tt.wantChanged) {
+				t.Errorf("changed = %v, want %v", got, tt.wantChanged)
+			}
+			if got := extensions(removed); !slices.Equal(got, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", got, tt.wantRemoved)
+			}
+			got := make(map[string]string)
+			for _, e := range c.List(func(string) bool { return true }, false) {
+				got[e.Extension] = e.Description
+			}
+			if !maps.Equal(got, tt.wantCache) {
+				t.Errorf("cache = %v, want %v", got, tt.wantCache)
+			}
+		})
+	}
+}
+
+func TestCacheApplyListingsAddsUnavailable(t *testing.T) {
+	c := NewCache()
+	c.ApplyListings(map[string]Listing{"101": {Description: "Reception"}})
+	e, ok := c.Snapshot("101")
+	if !ok {
+		t.Fatal("101 not cached")
+	}
+	if e.Status != Unavailable {
+		t.Errorf("status = %s, want %s", e.Status, Unavailable)
+	}
+}
+
+// extensions returns the sorted extensions of endpoints, nil if there are none
+func extensions(endpoints []Endpoint) []string {
+	var exts []string
+	for _, e := range endpoints {
+		exts = append(exts, e.Extension)
+	}
+	slices.Sort(exts)
+	return exts
+}
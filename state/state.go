@@ -0,0 +1,89 @@
+// Package state tracks the state of phone extensions as reported by
+// Asterisk: the State of each device, how the devices of an extension
+// combine, and a Cache of every extension.
+package state
+
+import "strings"
+
+// State is an Asterisk device state, as reported in DeviceStateChange events
+type State int
+
+// Every device state Asterisk reports (see ast_device_state in Asterisk's devicestate.h)
+const (
+	Unknown State = iota
+	NotInUse
+	InUse
+	Busy
+	Invalid
+	Unavailable
+	Ringing
+	RingInUse
+	OnHold
+)
+
+var stateInfo = map[State]struct {
+	name  string // as sent by Asterisk
+	label string // as shown to users and sent to clients
+	class string // CSS class of the table row
+}{
+	Unknown:     {"UNKNOWN", "Unknown", "disabled"},
+	NotInUse:    {"NOT_INUSE", "Not in use", ""},
+	InUse:       {"INUSE", "In use", "in-use"},
+	Busy:        {"BUSY", "Busy", "in-use"},
+	Invalid:     {"INVALID", "Invalid", "disabled"},
+	Unavailable: {"UNAVAILABLE", "Unavailable", "disabled"},
+	Ringing:     {"RINGING", "Ringing", "ringing"},
+	RingInUse:   {"RINGINUSE", "Ringing (in use)", "ring-in-use"},
+	OnHold:      {"ONHOLD", "On hold", "on-hold"},
+}
+
+// Parse converts an Asterisk device state name such as NOT_INUSE to a
+// State. User-facing labels such as "Not in use" are accepted too.
+// Anything unrecognised is Unknown.
+func Parse(s string) State {
+	state, _ := Lookup(s)
+	return state
+}
+
+// Lookup is Parse that also reports whether s was recognised
+func Lookup(s string) (State, bool) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "IDLE") {
+		return NotInUse, true
+	}
+	for state, info := range stateInfo {
+		if strings.EqualFold(s, info.name) || strings.EqualFold(s, info.label) {
+			return state, true
+		}
+	}
+	return Unknown, false
+}
+
+// String returns the user-facing label, e.g. "Not in use"
+func (s State) String() string {
+	if info, ok := stateInfo[s]; ok {
+		return info.label
+	}
+	return stateInfo[Unknown].label
+}
+
+// Class returns the CSS class used to display the state
+func (s State) Class() string {
+	return stateInfo[s].class
+}
+
+// Reachable reports whether a device in this state is registered and usable
+func (s State) Reachable() bool {
+	return s != Unknown && s != Invalid && s != Unavailable
+}
+
+// MarshalText encodes the state as its label, as the API has always done
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a label or Asterisk state name
+func (s *State) UnmarshalText(text []byte) error {
+	*s = Parse(string(text))
+	return nil
+}
@@ -18,6 +18,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
+                    'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
                 },
                 body: JSON.stringify({ password: password })
             });
@@ -30,6 +31,13 @@ document.addEventListener('DOMContentLoaded', function() {
                 // Refresh the page to show all extensions
                 window.location.reload();
             } else {
+                if (response.status === 429) {
+                    loginError.textContent = 'Too many failed attempts, please try again later';
+                } else if (response.status === 401) {
+                    loginError.textContent = 'Invalid password';
+                } else {
+                    loginError.textContent = await response.text();
+                }
                 loginError.classList.remove('d-none');
             }
         } catch (error) {
@@ -11,10 +11,27 @@ let currentSort = {
     document.querySelector('th.sortable.desc') ? 'desc' : 'asc'
 };
 
+// Row classes for each device state label, matching State.Class on the server
+const stateClasses = {
+  'not in use': '',
+  'in use': 'in-use',
+  'busy': 'in-use',
+  'on hold': 'on-hold',
+  'ringing': 'ringing',
+  'ringing (in use)': 'ring-in-use',
+  'unavailable': 'disabled',
+  'invalid': 'disabled',
+  'unknown': 'disabled',
+};
+
+// Natural order for mixed extensions, so 2 < 10 and door2 < door10. The
+// server's naturalLess matches it, so live rows land where it put them.
+const naturalCompare = new Intl.Collator(undefined, { numeric: true, sensitivity: 'base' }).compare;
+
 function sortTable(column) {
   const table = document.getElementById('status-table');
   const tbody = table.querySelector('tbody');
-  const rows = Array.from(tbody.querySelectorAll('tr'));
+  const rows = Array.from(tbody.querySelectorAll('tr[id^="e-"]'));
   const headers = table.querySelectorAll('th.sortable');
 
   // Update sort direction
@@ -34,23 +51,121 @@ function sortTable(column) {
 
   // Sort rows
   rows.sort((a, b) => {
-    let aVal, bVal;
-    if (column === 'extension') {
-      aVal = parseInt(a.querySelector('td').textContent, 10);
-      bVal = parseInt(b.querySelector('td').textContent, 10);
-    } else {
-      aVal = a.querySelector('td:nth-child(2)').textContent.toLowerCase();
-      bVal = b.querySelector('td:nth-child(2)').textContent.toLowerCase();
-    }
-
-    if (aVal < bVal) return currentSort.direction === 'asc' ? -1 : 1;
-    if (aVal > bVal) return currentSort.direction === 'asc' ? 1 : -1;
-    return 0;
+    const cell = column === 'extension' ? 'td' : 'td:nth-child(2)';
+    const order = naturalCompare(a.querySelector(cell).textContent, b.querySelector(cell).textContent);
+    return currentSort.direction === 'asc' ? order : -order;
   });
 
   // Reorder rows
   rows.forEach(row => tbody.appendChild(row));
+  applyView();
+}
+
+// Row metadata from the directory, e.g. department or site
+function rowMeta(row) {
+  try {
+    return JSON.parse(row.dataset.meta || 'null') || {};
+  } catch (e) {
+    return {};
+  }
+}
+
+// Free text matches extension, description or any metadata value;
+// "field:value" terms match a single metadata field
+function rowMatches(row, terms) {
+  const meta = rowMeta(row);
+  const text = (row.textContent + ' ' + Object.values(meta).join(' ')).toLowerCase();
+  return terms.every(term => {
+    const sep = term.indexOf(':');
+    if (sep > 0) {
+      const value = meta[term.slice(0, sep)];
+      return value !== undefined && value.toLowerCase().includes(term.slice(sep + 1));
+    }
+    return text.includes(term);
+  });
+}
+
+// Apply the search filter and grouping to the table
+function applyView() {
+  const tbody = document.querySelector('#status-table tbody');
+  if (!tbody) return;
+  const search = document.getElementById('search');
+  const groupBy = document.getElementById('group-by');
+  const terms = (search ? search.value : '').toLowerCase().split(/\s+/).filter(Boolean);
+  const key = groupBy ? groupBy.value : '';
+
+  tbody.querySelectorAll('tr.group-header').forEach(header => header.remove());
+  const rows = Array.from(tbody.querySelectorAll('tr[id^="e-"]'));
+  rows.forEach(row => { row.hidden = !rowMatches(row, terms); });
+  if (!key) return;
+
+  // Stable regroup, keeping the current sort order within each group
+  const groups = new Map();
+  rows.forEach(row => {
+    const name = rowMeta(row)[key] || 'Other';
+    if (!groups.has(name)) groups.set(name, []);
+    groups.get(name).push(row);
+  });
+  Array.from(groups.keys()).sort((a, b) => a.localeCompare(b)).forEach(name => {
+    const members = groups.get(name);
+    const header = document.createElement('tr');
+    header.className = 'group-header';
+    header.hidden = members.every(row => row.hidden);
+    const cell = document.createElement('th');
+    cell.colSpan = 4;
+    cell.textContent = name;
+    header.appendChild(cell);
+    tbody.appendChild(header);
+    members.forEach(row => tbody.appendChild(row));
+  });
+}
+
+// Seconds an extension may be unreachable before it is highlighted, 0 for never
+const staleAfter = parseInt(document.getElementById('status-table')?.dataset.staleAfter || '0', 10);
+
+// Short human duration, e.g. 45s, 12m, 3h 5m, 4d
+function formatDuration(ms) {
+  const s = Math.max(0, Math.floor(ms / 1000));
+  if (s < 60) return `${s}s`;
+  if (s < 3600) return `${Math.floor(s / 60)}m`;
+  if (s < 86400) return `${Math.floor(s / 3600)}h ${Math.floor(s % 3600 / 60)}m`;
+  return `${Math.floor(s / 86400)}d`;
+}
+
+// Show how long a row has been in its state, or when an unreachable
+// extension was last seen, and highlight long-unreachable ones
+function renderTimes(row) {
+  const cell = row.querySelector('td.since');
+  if (!cell) return;
+  const now = Date.now();
+  const since = cell.dataset.since ? Date.parse(cell.dataset.since) : NaN;
+  const lastSeen = cell.dataset.lastSeen ? Date.parse(cell.dataset.lastSeen) : NaN;
+  const unreachable = row.classList.contains('disabled');
+
+  if (unreachable && !isNaN(lastSeen)) {
+    cell.textContent = `seen ${formatDuration(now - lastSeen)} ago`;
+    cell.title = `Last seen ${new Date(lastSeen).toLocaleString()}`;
+  } else if (!isNaN(since)) {
+    cell.textContent = formatDuration(now - since);
+    cell.title = `Since ${new Date(since).toLocaleString()}`;
+  } else {
+    cell.textContent = '';
+    cell.title = '';
+  }
+
+  const reference = !isNaN(lastSeen) ? lastSeen : since;
+  row.classList.toggle('stale', unreachable && staleAfter > 0 && !isNaN(reference) &&
+    now - reference > staleAfter * 1000);
+}
+
+function renderAllTimes() {
+  document.querySelectorAll('#status-table tbody tr[id^="e-"]').forEach(renderTimes);
 }
+renderAllTimes();
+setInterval(renderAllTimes, 30000);
+
+document.getElementById('search')?.addEventListener('input', applyView);
+document.getElementById('group-by')?.addEventListener('change', applyView);
 
 // Add click handlers to sortable headers
 document.querySelectorAll('th.sortable').forEach(header => {
@@ -71,7 +186,9 @@ function connectSSE() {
     document.removeEventListener('visibilitychange', visibilityListener);
   }
 
-  sse = new EventSource("/events");
+  // Pass a signed URL token through so kiosk browsers keep their visibility scope
+  const sig = new URLSearchParams(window.location.search).get('sig');
+  sse = new EventSource(sig ? "/events?sig=" + encodeURIComponent(sig) : "/events");
 
   // watch for visibility changes when our SSE channel is closed
   visibilityListener = () => {
@@ -104,10 +221,64 @@ function connectSSE() {
     // Reset reconnect timeout on successful message
     reconnectTimeout = 1000;
 
+    // The greeting sent on connect is not a state update
+    if (e.data === 'Connected to updates') return;
+
     // Process other messages
     processStateUpdate(e.data);
   });
 
+  // Descriptions changed on the server (e.g. after a reload)
+  sse.addEventListener('description', (e) => {
+    const update = JSON.parse(e.data);
+    console.log(`Description change: ${update.extension} → ${update.description}`);
+    if (!document.getElementById("e-" + update.extension)) {
+      processStateUpdate(`${update.extension} ${update.status}`);
+    }
+    const row = document.getElementById("e-" + update.extension);
+    const descCell = row?.querySelector('td:nth-child(2) .description');
+    if (descCell) {
+      descCell.textContent = update.description;
+    }
+    if (row) {
+      row.dataset.meta = JSON.stringify(update.metadata || null);
+      applyView();
+    }
+  });
+
+  // When an extension entered its state and was last reachable
+  sse.addEventListener('times', (e) => {
+    const update = JSON.parse(e.data);
+    const row = document.getElementById("e-" + update.extension);
+    const cell = row?.querySelector('td.since');
+    if (cell) {
+      cell.dataset.since = update.since || '';
+      cell.dataset.lastSeen = update.last_seen || '';
+      renderTimes(row);
+    }
+  });
+
+  // Per-device detail, sent only to logged-in clients
+  sse.addEventListener('devices', (e) => {
+    const update = JSON.parse(e.data);
+    const statusCell = document.getElementById("e-" + update.extension)?.querySelector('td:nth-child(3)');
+    if (statusCell) {
+      statusCell.title = update.devices.map(d => `${d.Device}: ${d.Status}`).join('\n');
+    }
+  });
+
+  // Extension removed from the directory
+  sse.addEventListener('remove', (e) => {
+    console.log(`Extension removed: ${e.data}`);
+    document.getElementById("e-" + e.data)?.remove();
+  });
+
+  // Page configuration (e.g. branding) changed on the server
+  sse.addEventListener('reload', () => {
+    console.log('Configuration changed, reloading page');
+    location.reload();
+  });
+
   // Function to process state updates from SSE events
   function processStateUpdate(data) {
     const [extension, ...statusParts] = data.trim().split(' ');
@@ -116,29 +287,11 @@ function connectSSE() {
 
     console.log(`Status change: ${extension} → ${status}`);
 
-    // Only process if we have both extension and status, and extension is numeric
-    if (extension && status && /^\d+$/.test(extension)) {
+    // Only process if we have both extension and status; the server
+    // decides which devices count as extensions
+    if (extension && status) {
       // This is a state update message
-      // Convert status to display class and text
-      let displayClass = "";
-
-      switch (status.toLowerCase()) {
-        case 'not in use':
-          displayClass = ""; // Default state (green LED)
-          break;
-        case 'in use':
-          displayClass = "in-use"; // Match CSS class name
-          break;
-        case 'ringing':
-        case 'busy':
-          displayClass = "ringing"; // Match CSS class name
-          break;
-        case 'unavailable':
-        case 'unknown':
-        default:
-          displayClass = "disabled";
-          break;
-      }
+      const displayClass = stateClasses[status.toLowerCase()] ?? "disabled";
 
       // Find or create the table row
       let row = document.getElementById("e-" + extension);
@@ -156,7 +309,9 @@ function connectSSE() {
 
           // Create description cell (empty for new extensions)
           const descCell = document.createElement('td');
-          descCell.textContent = '';
+          const descSpan = document.createElement('span');
+          descSpan.className = 'description';
+          descCell.appendChild(descSpan);
           row.appendChild(descCell);
 
           // Create status cell (without LED indicator)
@@ -164,15 +319,18 @@ function connectSSE() {
           statusCell.textContent = status;
           row.appendChild(statusCell);
 
+          // Create the since cell, filled in by the times event
+          const sinceCell = document.createElement('td');
+          sinceCell.className = 'since';
+          row.appendChild(sinceCell);
+
           // Add device-state class to the extension cell for the LED indicator
           extCell.classList.add('device-state');
 
           // Insert the row in sorted order
-          const rows = Array.from(tbody.querySelectorAll('tr'));
-          const newExt = parseInt(extension, 10);
+          const rows = Array.from(tbody.querySelectorAll('tr[id^="e-"]'));
           let insertIndex = rows.findIndex(r => {
-            const ext = parseInt(r.querySelector('td').textContent, 10);
-            return ext > newExt;
+            return naturalCompare(r.querySelector('td').textContent, extension) > 0;
           });
 
           if (insertIndex === -1) {
@@ -180,13 +338,14 @@ function connectSSE() {
           } else {
             tbody.insertBefore(row, rows[insertIndex]);
           }
+          applyView();
         }
       }
 
       // Update the row if we have it
       if (row) {
         // First remove any existing status classes
-        row.classList.remove('in-use', 'ringing', 'busy', 'disabled');
+        row.classList.remove('in-use', 'ringing', 'on-hold', 'ring-in-use', 'disabled');
 
         // Then add the new class if it's not empty
         if (displayClass) {
@@ -194,9 +353,15 @@ function connectSSE() {
         }
 
         const statusCell = row.querySelector('td:nth-child(3)');
-        if (statusCell) {
+        if (statusCell && statusCell.textContent !== status) {
           statusCell.textContent = status;
+          // Assume the state changed now until the server's times event arrives
+          const sinceCell = row.querySelector('td.since');
+          if (sinceCell) {
+            sinceCell.dataset.since = new Date().toISOString();
+          }
         }
+        renderTimes(row);
       }
     }
   }
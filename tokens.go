@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope controls which extensions a client is allowed to see
+type Scope string
+
+const (
+	// ScopePublic sees only extensions matching extensions.public_pattern,
+	// as anonymous visitors do
+	ScopePublic Scope = "public"
+	// ScopeAll sees every extension, as logged-in operators do
+	ScopeAll Scope = "all"
+)
+
+// CanSee reports whether a client with this scope may see ext
+func (s Scope) CanSee(ext string) bool {
+	return s == ScopeAll || isPublic(ext)
+}
+
+// Detailed reports whether the scope may see per-device detail
+func (s Scope) Detailed() bool {
+	return s == ScopeAll
+}
+
+func parseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case ScopePublic, ScopeAll:
+		return Scope(s), nil
+	case "":
+		return ScopePublic, nil
+	default:
+		return "", fmt.Errorf("unknown scope %q", s)
+	}
+}
+
+// APIToken is a long-lived read-only bearer token. Only the SHA-256 hash of
+// the secret is stored; the plaintext is shown once when the token is created.
+type APIToken struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Scope    Scope     `json:"scope"`
+	Hash     string    `json:"hash,omitempty"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+// lastUsedSaveInterval is how often changed last-used times are written to
+// the token file, so busy tokens do not rewrite it on every request
+const lastUsedSaveInterval = time.Minute
+
+// TokenStore holds API tokens and persists them to a JSON file
+type TokenStore struct {
+	mu         sync.RWMutex
+	path       string
+	signingKey []byte
+	tokens     map[string]*APIToken // keyed by ID
+	byHash     map[string]*APIToken
+	// dirty is set when a last-used time has changed since the last save
+	dirty bool
+}
+
+// NewTokenStore loads tokens from path, creating an empty store if the file does not exist
+func NewTokenStore(path string, signingKey []byte) (*TokenStore, error) {
+	s := &TokenStore{
+		path:       path,
+		signingKey: signingKey,
+		tokens:     make(map[string]*APIToken),
+		byHash:     make(map[string]*APIToken),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	var tokens []*APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %v", err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.ID] = t
+		s.byHash[t.Hash] = t
+	}
+	return s, nil
+}
+
+// Create generates a new token and returns its record and plaintext secret
+func (s *TokenStore) Create(name string, scope Scope) (*APIToken, string, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := randomString(9)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext := "sipblf_" + secret
+
+	t := &APIToken{
+		ID:      id,
+		Name:    name,
+		Scope:   scope,
+		Hash:    hashToken(plaintext),
+		Created: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.ID] = t
+	s.byHash[t.Hash] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.ID)
+		delete(s.byHash, t.Hash)
+		return nil, "", err
+	}
+	return t, plaintext, nil
+}
+
+// Revoke deletes a token. Signed URLs derived from it stop working immediately.
+func (s *TokenStore) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.tokens, id)
+	delete(s.byHash, t.Hash)
+	return true, s.save()
+}
+
+// List returns all tokens sorted by creation time
+func (s *TokenStore) List() []APIToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Lookup returns the token matching a plaintext bearer secret
+func (s *TokenStore) Lookup(plaintext string) (*APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byHash[hashToken(plaintext)]
+	if ok {
+		s.touch(t)
+	}
+	return t, ok
+}
+
+// SignURL returns a signature granting the token's scope until expires, for
+// use as a ?sig= query parameter by browsers that cannot send headers.
+func (s *TokenStore) SignURL(id string, expires time.Time) (string, error) {
+	if len(s.signingKey) == 0 {
+		return "", errors.New("TOKEN_SIGNING_KEY is not set")
+	}
+	s.mu.RLock()
+	_, ok := s.tokens[id]
+	s.mu.RUnlock()
+	if !ok {
+		return "", errors.New("token not found")
+	}
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.sign(payload), nil
+}
+
+// VerifySignedURL checks a ?sig= value and returns the token it was derived from
+func (s *TokenStore) VerifySignedURL(sig string) (*APIToken, bool) {
+	if len(s.signingKey) == 0 {
+		return nil, false
+	}
+	idx := strings.LastIndex(sig, ".")
+	if idx == -1 {
+		return nil, false
+	}
+	payload, mac := sig[:idx], sig[idx+1:]
+	if !hmac.Equal([]byte(mac), []byte(s.sign(payload))) {
+		return nil, false
+	}
+	id, expStr, ok := strings.Cut(payload, ".")
+	if !ok {
+		return nil, false
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if ok {
+		s.touch(t)
+	}
+	return t, ok
+}
+
+// touch records that a token was used. Caller must hold s.mu.
+func (s *TokenStore) touch(t *APIToken) {
+	t.LastUsed = time.Now().UTC()
+	s.dirty = true
+}
+
+// SaveLastUsed periodically writes changed last-used times to the token file
+func (s *TokenStore) SaveLastUsed(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		if s.dirty {
+			if err := s.save(); err != nil {
+				log.Printf("Warning: Failed to save API token last-used times: %v", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *TokenStore) sign(payload string) string {
+	m := hmac.New(sha256.New, s.signingKey)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// save writes the token file atomically. Caller must hold s.mu.
+func (s *TokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tokens-*")
+	if err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func hashToken(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// errInvalidToken is returned when a request presents a token that is unknown or revoked
+var errInvalidToken = errors.New("invalid or revoked token")
+
+// requestToken returns the API token in the request's Authorization header
+func requestToken(r *http.Request) (*APIToken, error) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errInvalidToken
+	}
+	t, ok := apiTokens.Lookup(strings.TrimSpace(bearer))
+	if !ok {
+		return nil, errInvalidToken
+	}
+	return t, nil
+}
+
+// requestScope works out what a request may see: a bearer token or signed
+// URL grants that token's scope, a logged-in session sees everything, and
+// anonymous requests get the public scope.
+func requestScope(r *http.Request) (Scope, error) {
+	if r.Header.Get("Authorization") != "" {
+		t, err := requestToken(r)
+		if err != nil {
+			return "", err
+		}
+		return t.Scope, nil
+	}
+	if isAdmin(r) {
+		return ScopeAll, nil
+	}
+	if sig := r.URL.Query().Get("sig"); sig != "" {
+		t, ok := apiTokens.VerifySignedURL(sig)
+		if !ok {
+			return "", errInvalidToken
+		}
+		return t.Scope, nil
+	}
+	return ScopePublic, nil
+}
+
+// isAdmin reports whether the request carries a logged-in admin session. A
+// request presenting an API token is judged by the token alone, and tokens
+// are read-only, so the session cookie sent alongside it does not count.
+func isAdmin(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	return sessionManager.GetBool(r.Context(), "authenticated")
+}
+
+// requireAdmin rejects requests that do not carry a logged-in admin session
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerTokenRoutes adds the admin API for managing API tokens
+func registerTokenRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/tokens", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		tokens := apiTokens.List()
+		for i := range tokens {
+			tokens[i].Hash = "" // never hand out hashes
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	}))
+
+	mux.HandleFunc("POST /api/admin/tokens", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name  string `json:"name"`
+			Scope string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		scope, err := parseScope(req.Scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, plaintext, err := apiTokens.Create(req.Name, scope)
+		if err != nil {
+			slog.Error("Failed to create API token", "error", err)
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("API token created", "audit", "token", "id", t.ID, "name", t.Name, "scope", t.Scope, "client_ip", clientIP(r))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"token": plaintext,
+			"id":    t.ID,
+			"name":  t.Name,
+			"scope": t.Scope,
+		})
+	}))
+
+	mux.HandleFunc("DELETE /api/admin/tokens/{id}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		found, err := apiTokens.Revoke(id)
+		if err != nil {
+			slog.Error("Failed to revoke API token", "id", id, "error", err)
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("API token revoked", "audit", "token", "id", id, "client_ip", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("POST /api/admin/tokens/{id}/signed-url", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			TTL string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		ttl := 365 * 24 * time.Hour
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		expires := time.Now().Add(ttl)
+		sig, err := apiTokens.SignURL(r.PathValue("id"), expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"url":     "/?sig=" + sig,
+			"expires": expires.UTC(),
+		})
+	}))
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Failed to write JSON response", "error", err)
+	}
+}
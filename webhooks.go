@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"sipblf/state"
+)
+
+// WebhookEvent is the JSON body of a webhook delivery
+type WebhookEvent struct {
+	// ID is unique per event and repeated on retries, for deduplication
+	ID string `json:"id"`
+	// Type is "state_change", or "test" for deliveries sent from the admin API
+	Type        string      `json:"type"`
+	Time        time.Time   `json:"time"`
+	Extension   string      `json:"extension"`
+	Description string      `json:"description,omitempty"`
+	Device      string      `json:"device,omitempty"`
+	From        state.State `json:"from"`
+	To          state.State `json:"to"`
+}
+
+// WebhookStatus is the delivery status of one subscription
+type WebhookStatus struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Queued int    `json:"queued"`
+	// Delivered counts events the receiver accepted
+	Delivered int64 `json:"delivered"`
+	// Retries counts failed attempts that were tried again
+	Retries int64 `json:"retries"`
+	// Failed counts events given up on and written to the dead-letter log
+	Failed              int64     `json:"failed"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorTime       time.Time `json:"last_error_time,omitzero"`
+}
+
+// DeadLetter is an event that could not be delivered
+type DeadLetter struct {
+	Time         time.Time    `json:"time"`
+	Subscription string       `json:"subscription"`
+	URL          string       `json:"url"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	Event        WebhookEvent `json:"event"`
+}
+
+// webhookSubscription is a configured subscription with its own queue and
+// delivery goroutine, so a slow receiver does not hold up the others and
+// each receiver gets its events in order
+type webhookSubscription struct {
+	config     WebhookSubscriptionConfig
+	extensions *regexp.Regexp
+	states     []state.State
+	queue      chan WebhookEvent
+	stop       chan struct{}
+
+	mu     sync.Mutex
+	status WebhookStatus
+}
+
+// matches reports whether the subscription wants a change of ext into status
+func (s *webhookSubscription) matches(ext string, status state.State) bool {
+	if !s.extensions.MatchString(ext) {
+		return false
+	}
+	return len(s.states) == 0 || slices.Contains(s.states, status)
+}
+
+// WebhookDispatcher delivers state changes to webhook subscriptions
+type WebhookDispatcher struct {
+	mu            sync.RWMutex
+	settings      WebhooksConfig
+	subscriptions []*webhookSubscription
+	client        *http.Client
+
+	deadLetterMu sync.Mutex
+	// deadLetters queues dead letters for writeDeadLetters, so that
+	// Publish never waits for the disk
+	deadLetters    chan deadLetterWrite
+	deadLetterOnce sync.Once
+}
+
+// deadLetterWrite is an encoded dead letter waiting to be appended to a log
+type deadLetterWrite struct {
+	path string
+	line []byte
+}
+
+// webhooks is the configured webhook dispatcher
+var webhooks = &WebhookDispatcher{client: &http.Client{}, deadLetters: make(chan deadLetterWrite, 1000)}
+
+// Configure replaces the subscriptions and retry settings. Unchanged
+// subscriptions keep their queue and status; events still queued for a
+// removed or changed subscription go to the dead-letter log.
+func (d *WebhookDispatcher) Configure(c WebhooksConfig) error {
+	apply, err := d.Prepare(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare builds the subscriptions of a configuration and returns a
+// function that switches to them, as Configure does
+func (d *WebhookDispatcher) Prepare(c WebhooksConfig) (func(), error) {
+	d.mu.RLock()
+	old := make(map[string]*webhookSubscription)
+	for _, sub := range d.subscriptions {
+		old[sub.config.Name] = sub
+	}
+	d.mu.RUnlock()
+
+	var subscriptions, started []*webhookSubscription
+	kept := make(map[*webhookSubscription]bool)
+	for _, sc := range c.Subscriptions {
+		if prev, ok := old[sc.Name]; ok && reflect.DeepEqual(prev.config, sc) {
+			subscriptions = append(subscriptions, prev)
+			kept[prev] = true
+			continue
+		}
+		re, err := regexp.Compile(sc.Extensions)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %s: %v", sc.Name, err)
+		}
+		sub := &webhookSubscription{
+			config:     sc,
+			extensions: re,
+			queue:      make(chan WebhookEvent, 1000),
+			stop:       make(chan struct{}),
+			status:     WebhookStatus{Name: sc.Name, URL: sc.URL},
+		}
+		for _, s := range sc.States {
+			sub.states = append(sub.states, state.Parse(s))
+		}
+		subscriptions = append(subscriptions, sub)
+		started = append(started, sub)
+	}
+
+	return func() {
+		d.mu.Lock()
+		d.settings = c
+		d.subscriptions = subscriptions
+		d.mu.Unlock()
+
+		for _, sub := range old {
+			if !kept[sub] {
+				close(sub.stop)
+			}
+		}
+		for _, sub := range started {
+			go d.run(sub)
+		}
+	}, nil
+}
+
+// Publish queues a state change for every subscription that wants it. It
+// never blocks: if a subscription's queue is full the event goes straight
+// to the dead-letter log. The lock is held while queueing so that a
+// reconfiguration cannot stop a subscription between the two, leaving an
+// event in a queue nothing will drain.
+func (d *WebhookDispatcher) Publish(t state.Transition, endpoint state.Endpoint) {
+	var dropped []droppedEvent
+	d.mu.RLock()
+	for _, sub := range d.subscriptions {
+		if !sub.matches(t.Extension, t.To) {
+			continue
+		}
+		id, err := randomString(12)
+		if err != nil {
+			log.Printf("Warning: Failed to create webhook event ID: %v", err)
+			break
+		}
+		event := WebhookEvent{
+			ID:          id,
+			Type:        "state_change",
+			Time:        t.Time,
+			Extension:   t.Extension,
+			Description: endpoint.Description,
+			Device:      t.Device,
+			From:        t.From,
+			To:          t.To,
+		}
+		if !enqueue(sub, event) {
+			dropped = append(dropped, droppedEvent{sub, event})
+		}
+	}
+	d.mu.RUnlock()
+
+	// fail takes the lock itself
+	for _, e := range dropped {
+		d.fail(e.sub, e.event, 0, fmt.Errorf("queue full"))
+	}
+}
+
+// droppedEvent is an event that did not fit in its subscription's queue
+type droppedEvent struct {
+	sub   *webhookSubscription
+	event WebhookEvent
+}
+
+// Test queues a test event for the named subscription, whatever its filters
+func (d *WebhookDispatcher) Test(name string) (WebhookEvent, bool, error) {
+	d.mu.RLock()
+	var sub *webhookSubscription
+	for _, s := range d.subscriptions {
+		if s.config.Name == name {
+			sub = s
+			break
+		}
+	}
+	if sub == nil {
+		d.mu.RUnlock()
+		return WebhookEvent{}, false, nil
+	}
+	id, err := randomString(12)
+	if err != nil {
+		d.mu.RUnlock()
+		return WebhookEvent{}, true, err
+	}
+	event := WebhookEvent{
+		ID:        id,
+		Type:      "test",
+		Time:      time.Now().UTC(),
+		Extension: "test",
+		From:      state.NotInUse,
+		To:        state.InUse,
+	}
+	queued := enqueue(sub, event)
+	d.mu.RUnlock()
+
+	if !queued {
+		d.fail(sub, event, 0, fmt.Errorf("queue full"))
+	}
+	return event, true, nil
+}
+
+// enqueue adds an event to a subscription's queue without waiting,
+// reporting whether there was room
+func enqueue(sub *webhookSubscription, event WebhookEvent) bool {
+	select {
+	case sub.queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status returns the delivery status of every subscription
+func (d *WebhookDispatcher) Status() []WebhookStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	statuses := make([]WebhookStatus, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		sub.mu.Lock()
+		status := sub.status
+		sub.mu.Unlock()
+		status.Queued = len(sub.queue)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// run delivers a subscription's events one at a time until it is stopped
+func (d *WebhookDispatcher) run(sub *webhookSubscription) {
+	for {
+		select {
+		case <-sub.stop:
+			for {
+				select {
+				case event := <-sub.queue:
+					d.fail(sub, event, 0, fmt.Errorf("subscription removed or changed before delivery"))
+				default:
+					return
+				}
+			}
+		case event := <-sub.queue:
+			d.deliver(sub, event)
+		}
+	}
+}
+
+// deliver tries an event until the receiver accepts it, the attempts run
+// out, or the receiver rejects it with a client error other than 408 or 429
+func (d *WebhookDispatcher) deliver(sub *webhookSubscription, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.fail(sub, event, 0, err)
+		return
+	}
+
+	backoff := time.Duration(0)
+	for attempt := 1; ; attempt++ {
+		d.mu.RLock()
+		settings := d.settings
+		d.mu.RUnlock()
+
+		retry, err := d.post(sub, settings.Timeout, event, body)
+		if err == nil {
+			sub.mu.Lock()
+			sub.status.Delivered++
+			sub.status.ConsecutiveFailures = 0
+			sub.status.LastSuccess = time.Now().UTC()
+			sub.mu.Unlock()
+			slog.Debug("Webhook delivered", "subscription", sub.config.Name, "event", event.ID, "attempt", attempt)
+			return
+		}
+
+		sub.mu.Lock()
+		sub.status.ConsecutiveFailures++
+		sub.status.LastError = err.Error()
+		sub.status.LastErrorTime = time.Now().UTC()
+		sub.mu.Unlock()
+		if !retry || attempt >= settings.MaxAttempts {
+			d.fail(sub, event, attempt, err)
+			return
+		}
+
+		if backoff == 0 {
+			backoff = settings.Backoff
+		} else {
+			backoff = min(backoff*2, settings.MaxBackoff)
+		}
+		slog.Debug("Webhook delivery failed, retrying", "subscription", sub.config.Name, "event", event.ID, "attempt", attempt, "backoff", backoff, "error", err)
+		sub.mu.Lock()
+		sub.status.Retries++
+		sub.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-sub.stop:
+			d.fail(sub, event, attempt, fmt.Errorf("subscription removed or changed while retrying: %v", err))
+			return
+		}
+	}
+}
+
+// post makes one delivery attempt, reporting whether a failure is worth retrying
+func (d *WebhookDispatcher) post(sub *webhookSubscription, timeout time.Duration, event WebhookEvent, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range sub.config.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Sipblf-Event", event.Type)
+	req.Header.Set("X-Sipblf-Delivery", event.ID)
+	req.Header.Set("X-Sipblf-Timestamp", timestamp)
+	req.Header.Set("X-Sipblf-Signature", "sha256="+signWebhook(sub.config.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("rejected with status %s", resp.Status)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(timestamp))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// fail gives up on an event, recording it in the dead-letter log. The
+// write happens in the background, as fail may be called from Publish.
+func (d *WebhookDispatcher) fail(sub *webhookSubscription, event WebhookEvent, attempts int, err error) {
+	sub.mu.Lock()
+	sub.status.Failed++
+	sub.mu.Unlock()
+	log.Printf("Warning: Webhook %s gave up on event %s for %s after %d attempts: %v",
+		sub.config.Name, event.ID, event.Extension, attempts, err)
+
+	d.mu.RLock()
+	path := d.settings.DeadLetterPath
+	d.mu.RUnlock()
+	if path == "" {
+		return
+	}
+	line, jerr := json.Marshal(DeadLetter{
+		Time:         time.Now().UTC(),
+		Subscription: sub.config.Name,
+		URL:          sub.config.URL,
+		Attempts:     attempts,
+		Error:        err.Error(),
+		Event:        event,
+	})
+	if jerr != nil {
+		log.Printf("Warning: Failed to encode dead letter: %v", jerr)
+		return
+	}
+
+	d.deadLetterOnce.Do(func() { go d.writeDeadLetters() })
+	select {
+	case d.deadLetters <- deadLetterWrite{path: path, line: append(line, '\n')}:
+	default:
+		log.Printf("Warning: Dead-letter log %s is not keeping up, event %s for %s not recorded", path, event.ID, event.Extension)
+	}
+}
+
+// writeDeadLetters appends queued dead letters to their logs
+func (d *WebhookDispatcher) writeDeadLetters() {
+	for w := range d.deadLetters {
+		d.writeDeadLetter(w)
+	}
+}
+
+func (d *WebhookDispatcher) writeDeadLetter(w deadLetterWrite) {
+	d.deadLetterMu.Lock()
+	defer d.deadLetterMu.Unlock()
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Warning: Failed to open dead-letter log %s: %v", w.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(w.line); err != nil {
+		log.Printf("Warning: Failed to write dead-letter log %s: %v", w.path, err)
+	}
+}
+
+// DeadLetters returns up to limit of the most recent dead letters, newest first
+func (d *WebhookDispatcher) DeadLetters(limit int) ([]DeadLetter, error) {
+	d.mu.RLock()
+	path := d.settings.DeadLetterPath
+	d.mu.RUnlock()
+	letters := []DeadLetter{}
+	if path == "" {
+		return letters, nil
+	}
+
+	d.deadLetterMu.Lock()
+	defer d.deadLetterMu.Unlock()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return letters, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var l DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			continue
+		}
+		letters = append(letters, l)
+		if len(letters) > limit {
+			letters = letters[1:]
+		}
+	}
+	slices.Reverse(letters)
+	return letters, scanner.Err()
+}
+
+// registerWebhookRoutes adds the admin API for webhook delivery status
+func registerWebhookRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/webhooks", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if ingestOnly(w, "Webhook status") {
+			return
+		}
+		writeJSON(w, http.StatusOK, webhooks.Status())
+	}))
+
+	mux.HandleFunc("GET /api/admin/webhooks/dead-letters", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if ingestOnly(w, "Webhook status") {
+			return
+		}
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 10000 {
+				http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		letters, err := webhooks.DeadLetters(limit)
+		if err != nil {
+			slog.Error("Failed to read dead-letter log", "error", err)
+			http.Error(w, "Failed to read dead-letter log", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, letters)
+	}))
+
+	mux.HandleFunc("POST /api/admin/webhooks/{name}/test", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if ingestOnly(w, "Webhook delivery") {
+			return
+		}
+		event, ok, err := webhooks.Test(r.PathValue("name"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Webhook test queued", "audit", "webhook_test", "subscription", r.PathValue("name"), "client_ip", clientIP(r))
+		writeJSON(w, http.StatusAccepted, event)
+	}))
+}
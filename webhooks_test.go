@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sipblf/state"
+)
+
+// webhookReceiver records deliveries, answering each with the next of its
+// statuses and then with 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	rc.times = append(rc.times, time.Now())
+	if len(rc.statuses) > 0 {
+		w.WriteHeader(rc.statuses[0])
+		rc.statuses = rc.statuses[1:]
+	}
+}
+
+// testWebhooks starts a dispatcher delivering to a test receiver
+func testWebhooks(t *testing.T, rc *webhookReceiver, c WebhooksConfig) *WebhookDispatcher {
+	t.Helper()
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	d := &WebhookDispatcher{client: srv.Client(), deadLetters: make(chan deadLetterWrite, 10)}
+	for i := range c.Subscriptions {
+		c.Subscriptions[i].URL = srv.URL + "/hook"
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 3
+	}
+	c.Timeout = time.Second
+	if err := d.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Configure(WebhooksConfig{}) })
+	return d
+}
+
+// waitFor polls until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func change(ext string, to state.State) state.Transition {
+	return state.Transition{Time: time.Now().UTC(), Extension: ext, Device: "PJSIP/" + ext, From: state.NotInUse, To: to}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rc := &webhookReceiver{}
+	d := testWebhooks(t, rc, WebhooksConfig{Subscriptions: []WebhookSubscriptionConfig{
+		{Name: "crm", Secret: "s3cret", Headers: map[string]string{"X-Api-Key": "key"}},
+	}})
+	d.Publish(change("100", state.InUse), state.Endpoint{Description: "Reception"})
+	waitFor(t, "a delivery", func() bool { return d.Status()[0].Delivered == 1 })
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	r, body := rc.requests[0], rc.bodies[0]
+	m := hmac.New(sha256.New, []byte("s3cret"))
+	m.Write([]byte(r.Header.Get("X-Sipblf-Timestamp") + "."))
+	m.Write(body)
+	if got, want := r.Header.Get("X-Sipblf-Signature"), "sha256="+hex.EncodeToString(m.Sum(nil)); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if r.Header.Get("X-Api-Key") != "key" || r.Header.Get("X-Sipblf-Event") != "state_change" {
+		t.Errorf("headers %v", r.Header)
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Extension != "100" || event.Description != "Reception" || event.To != state.InUse || event.ID != r.Header.Get("X-Sipblf-Delivery") {
+		t.Errorf("event %+v", event)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	rc := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	d := testWebhooks(t, rc, WebhooksConfig{
+		Subscriptions: []WebhookSubscriptionConfig{{Name: "crm"}},
+		MaxAttempts:   3,
+		Backoff:       20 * time.Millisecond,
+		MaxBackoff:    time.Second,
+	})
+	d.Publish(change("100", state.InUse), state.Endpoint{})
+	waitFor(t, "a delivery", func() bool { return d.Status()[0].Delivered == 1 })
+
+	if status := d.Status()[0]; status.Retries != 2 || status.Failed != 0 || status.ConsecutiveFailures != 0 {
+		t.Errorf("status %+v, want 2 retries and no failures", status)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.requests) != 3 {
+		t.Fatalf("%d attempts, want 3", len(rc.requests))
+	}
+	// The same event each time, after a doubling backoff
+	for i, wait := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if gap := rc.times[i+1].Sub(rc.times[i]); gap < wait {
+			t.Errorf("attempt %d after %v, want at least %v", i+2, gap, wait)
+		}
+		if id := rc.requests[i+1].Header.Get("X-Sipblf-Delivery"); id != rc.requests[0].Header.Get("X-Sipblf-Delivery") {
+			t.Errorf("attempt %d delivered %s, want the first event again", i+2, id)
+		}
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+	}{
+		{"attempts run out", []int{500, 502, 503}, 3},
+		{"client errors are not retried", []int{http.StatusBadRequest}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &webhookReceiver{statuses: tt.statuses}
+			d := testWebhooks(t, rc, WebhooksConfig{
+				Subscriptions:  []WebhookSubscriptionConfig{{Name: "crm"}},
+				MaxAttempts:    3,
+				Backoff:        time.Millisecond,
+				MaxBackoff:     time.Millisecond,
+				DeadLetterPath: filepath.Join(t.TempDir(), "dead-letters.jsonl"),
+			})
+			d.Publish(change("100", state.Unavailable), state.Endpoint{})
+
+			var letters []DeadLetter
+			waitFor(t, "a dead letter", func() bool {
+				var err error
+				letters, err = d.DeadLetters(10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(letters) > 0
+			})
+			l := letters[0]
+			if len(letters) != 1 || l.Subscription != "crm" || l.Attempts != tt.wantAttempts || l.Event.Extension != "100" || l.Event.To != state.Unavailable {
+				t.Errorf("dead letters %+v, want one for 100 after %d attempts", letters, tt.wantAttempts)
+			}
+			if status := d.Status()[0]; status.Failed != 1 || status.Delivered != 0 || status.LastError == "" {
+				t.Errorf("status %+v", status)
+			}
+		})
+	}
+}
+
+func TestWebhookFilters(t *testing.T) {
+	rc := &webhookReceiver{}
+	d := testWebhooks(t, rc, WebhooksConfig{Subscriptions: []WebhookSubscriptionConfig{
+		{Name: "all"},
+		{Name: "sales", Extensions: "^2[0-9]{2}$"},
+		{Name: "ringing", States: []string{"RINGING", "RINGINUSE"}},
+		{Name: "sales-down", Extensions: "^2", States: []string{"UNAVAILABLE"}},
+	}})
+
+	tests := []struct {
+		ext  string
+		to   state.State
+		want []string
+	}{
+		{"100", state.InUse, []string{"all"}},
+		{"200", state.InUse, []string{"all", "sales"}},
+		{"2000", state.InUse, []string{"all"}},
+		{"100", state.RingInUse, []string{"all", "ringing"}},
+		{"201", state.Ringing, []string{"all", "sales", "ringing"}},
+		{"201", state.Unavailable, []string{"all", "sales", "sales-down"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, sub := range d.subscriptions {
+			if sub.matches(tt.ext, tt.to) {
+				got = append(got, sub.config.Name)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s to %v: matched %v, want %v", tt.ext, tt.to, got, tt.want)
+		}
+	}
+
+	// Published changes reach only the subscriptions that match
+	d.Publish(change("201", state.Unavailable), state.Endpoint{})
+	waitFor(t, "deliveries", func() bool {
+		var delivered int64
+		for _, status := range d.Status() {
+			delivered += status.Delivered
+		}
+		return delivered >= 3
+	})
+	for _, status := range d.Status() {
+		want := int64(0)
+		if status.Name != "ringing" {
+			want = 1
+		}
+		if status.Delivered != want {
+			t.Errorf("%s: delivered %d, want %d", status.Name, status.Delivered, want)
+		}
+	}
+}
+
+// TestWebhookReconfigure publishes while the subscription keeps changing:
+// every event must be delivered or dead-lettered, none left in a stopped queue
+func TestWebhookReconfigure(t *testing.T) {
+	rc := &webhookReceiver{}
+	c := WebhooksConfig{Subscriptions: []WebhookSubscriptionConfig{{Name: "crm"}}}
+	d := testWebhooks(t, rc, c)
+	c = d.settings
+
+	subs := make(map[*webhookSubscription]bool)
+	const publishers, events = 4, 1000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range events / publishers {
+				d.Publish(change("100", state.InUse), state.Endpoint{})
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		d.mu.RLock()
+		for _, sub := range d.subscriptions {
+			subs[sub] = true
+		}
+		d.mu.RUnlock()
+		select {
+		case <-done:
+		default:
+			c.Subscriptions[0].Secret = strconv.Itoa(i)
+			if err := d.Configure(c); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		break
+	}
+
+	waitFor(t, "every event to be delivered or dead-lettered", func() bool {
+		var handled int64
+		for sub := range subs {
+			sub.mu.Lock()
+			handled += sub.status.Delivered + sub.status.Failed
+			sub.mu.Unlock()
+		}
+		return handled == events
+	})
+}